@@ -18,16 +18,22 @@ package catshadow
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"sync"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/katzenpost/channels"
 	"github.com/katzenpost/client"
+	"github.com/katzenpost/client/config"
 	"github.com/katzenpost/client/poisson"
 	"github.com/katzenpost/client/session"
+	"github.com/katzenpost/client/utils"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/core/log"
@@ -36,7 +42,10 @@ import (
 	"github.com/katzenpost/memspool/common"
 	pclient "github.com/katzenpost/panda/client"
 	panda "github.com/katzenpost/panda/crypto"
+	panda_proto "github.com/katzenpost/panda/crypto/proto"
 	"github.com/ugorji/go/codec"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/sha3"
 	"gopkg.in/op/go-logging.v1"
 )
 
@@ -47,14 +56,40 @@ const (
 	readInboxPoissonMax    = 90000
 )
 
+// errHalted is returned by the synchronous command API
+// when the Client shuts down before replying.
+var errHalted = errors.New("catshadow: client halted")
+
 type addContact struct {
-	Name         string
-	SharedSecret []byte
+	Name            string
+	SharedSecret    []byte
+	Manual          bool
+	SpoolReaderChan *channels.UnreliableSpoolReaderChannel
+	ResponseChan    chan error
 }
 
 type sendMessage struct {
-	Name    string
-	Payload []byte
+	ID           MessageID
+	Name         string
+	Payload      []byte
+	ResponseChan chan error
+}
+
+type rotateSpool struct {
+	Name            string
+	SpoolReaderChan *channels.UnreliableSpoolReaderChannel
+	ResponseChan    chan error
+}
+
+type removeContact struct {
+	Name         string
+	ResponseChan chan error
+}
+
+type restartKeyExchange struct {
+	Name         string
+	SharedSecret []byte
+	ResponseChan chan error
 }
 
 // Client is the mixnet client which interacts with other clients
@@ -65,33 +100,82 @@ type Client struct {
 	pandaChan         chan panda.PandaUpdate
 	addContactChan    chan addContact
 	getNicknamesChan  chan chan []string
+	getContactsChan   chan chan []*ContactInfo
 	sendMessageChan   chan sendMessage
-	removeContactChan chan string
-
-	stateWorker           *StateWriter
-	linkKey               *ecdh.PrivateKey
-	user                  string
-	contacts              map[uint64]*Contact
-	contactNicknames      map[string]*Contact
-	spoolReaderChan       *channels.UnreliableSpoolReaderChannel
-	inbox                 []*Message
-	inboxMutex            *sync.Mutex
-	readInboxPoissonTimer *poisson.Fount
+	removeContactChan chan removeContact
+	restartKxChan     chan restartKeyExchange
+	rotateSpoolChan   chan rotateSpool
+	sendFileChan      chan sendFile
+	acceptFileChan    chan acceptFile
+	getTransfersChan  chan chan []*FileTransferInfo
+	deleteMessageChan chan deleteMessage
+	setRetentionChan  chan setRetention
+	eventCh           chan Event
+
+	introduceChan          chan introduce
+	acceptIntroductionChan chan acceptIntroduction
+	getIntroductionsChan   chan chan []*IntroductionInfo
+
+	exportContactExchangeChan chan exportContactExchange
+	importContactExchangeChan chan importContactExchange
+	getSafetyNumberChan       chan getSafetyNumber
+	setVerifiedChan           chan setVerified
+
+	drainChan    chan chan error
+	drainWaiters []chan error
+	saveChan     chan struct{}
+
+	stateWorker       *StateWriter
+	linkKey           *ecdh.PrivateKey
+	user              string
+	contacts          map[uint64]*Contact
+	contactNicknames  map[string]*Contact
+	spoolReaderChan   *channels.UnreliableSpoolReaderChannel
+	inbox             []*Message
+	inboxMutex        *sync.Mutex
+	partialMessages   []*partialMessage
+	sentMessages      []*SentMessage
+	sentMessagesMutex *sync.Mutex
+	outbox            []*outboxEntry
+	outboxInFlight    map[*outboxEntry]bool
+	quarantine        []*quarantinedMessage
+	quarantineTimeout time.Duration
+	transfers         []*fileTransfer
+	downloadDir       string
+	retention         time.Duration
+	isConnected       bool
+	spoolDrainLimit   int
+	readsInFlight     map[string]bool
+	readCursor        int
+	spoolRecovery     bool
+	spoolRecoveries   map[uint64]bool
+
+	introductions         []*introduction
+	receivedIntroductions []*receivedIntroduction
+
+	readInboxResultChan     chan readInboxResult
+	spoolWriteResultChan    chan spoolWriteResult
+	spoolRecoveryResultChan chan spoolRecoveryResult
+	readInboxPoissonTimer   *poisson.Fount
 
 	client       *client.Client
 	session      *session.Session
 	spoolService memspoolclient.SpoolService
 
+	// spoolDescriptor returns the spool service
+	// on which new remote spools are created.
+	spoolDescriptor func() (*utils.ServiceDescriptor, error)
+
 	log        *logging.Logger
 	logBackend *log.Backend
 }
 
-// NewClientAndRemoteSpool creates a new Client and creates a new remote spool
-// for collecting messages destined to this Client. The Client is associated with
-// this remote spool and this state is preserved in the encrypted statefile, of course.
+// NewClientAndState creates a new Client with a new state, which is
+// saved to the statefile. Each contact is given a remote spool of its
+// own when it is added, so no remote spool is created for the Client.
 // This constructor of Client is used when creating a new Client as opposed to loading
 // the previously saved state for an existing Client.
-func NewClientAndRemoteSpool(logBackend *log.Backend, mixnetClient *client.Client, stateWorker *StateWriter, user string, linkKey *ecdh.PrivateKey) (*Client, error) {
+func NewClientAndState(logBackend *log.Backend, mixnetClient *client.Client, stateWorker *StateWriter, user string, linkKey *ecdh.PrivateKey) (*Client, error) {
 	state := &State{
 		Contacts: make([]*Contact, 0),
 		Inbox:    make([]*Message, 0),
@@ -103,14 +187,16 @@ func NewClientAndRemoteSpool(logBackend *log.Backend, mixnetClient *client.Clien
 		return nil, err
 	}
 	client.save()
-	err = client.CreateRemoteSpool()
-	if err != nil {
-		return nil, err
-	}
-	client.save()
 	return client, nil
 }
 
+// NewClientAndRemoteSpool creates a new Client with a new state.
+//
+// Deprecated: no remote spool is created any more, use NewClientAndState.
+func NewClientAndRemoteSpool(logBackend *log.Backend, mixnetClient *client.Client, stateWorker *StateWriter, user string, linkKey *ecdh.PrivateKey) (*Client, error) {
+	return NewClientAndState(logBackend, mixnetClient, stateWorker, user, linkKey)
+}
+
 // New creates a new Client instance given a mixnetClient, stateWorker and state.
 // This constructor is used to load the previously saved state of a Client.
 func New(logBackend *log.Backend, mixnetClient *client.Client, stateWorker *StateWriter, state *State) (*Client, error) {
@@ -118,35 +204,84 @@ func New(logBackend *log.Backend, mixnetClient *client.Client, stateWorker *Stat
 	if err != nil {
 		return nil, err
 	}
+	c := newClient(logBackend, stateWorker, state, memspoolclient.New(session))
+	c.client = mixnetClient
+	c.session = session
+	c.spoolDescriptor = func() (*utils.ServiceDescriptor, error) {
+		return session.GetService(common.SpoolServiceName)
+	}
+	return c, nil
+}
+
+// newClient creates a Client which uses the given spool service,
+// it is not yet connected to the mixnet.
+func newClient(logBackend *log.Backend, stateWorker *StateWriter, state *State, spoolService memspoolclient.SpoolService) *Client {
+	assignMessageIDs(state.Inbox)
 	c := &Client{
-		pandaChan:         make(chan panda.PandaUpdate),
-		addContactChan:    make(chan addContact),
-		sendMessageChan:   make(chan sendMessage),
-		getNicknamesChan:   make(chan chan []string),
-		removeContactChan: make(chan string),
-		contacts:          make(map[uint64]*Contact),
-		contactNicknames:  make(map[string]*Contact),
-		spoolReaderChan:   state.SpoolReaderChan,
-		linkKey:           state.LinkKey,
-		user:              state.User,
-		inbox:             state.Inbox,
-		inboxMutex:        new(sync.Mutex),
-		stateWorker:       stateWorker,
+		pandaChan:               make(chan panda.PandaUpdate),
+		addContactChan:          make(chan addContact),
+		sendMessageChan:         make(chan sendMessage),
+		getNicknamesChan:        make(chan chan []string),
+		getContactsChan:         make(chan chan []*ContactInfo),
+		removeContactChan:       make(chan removeContact),
+		restartKxChan:           make(chan restartKeyExchange),
+		rotateSpoolChan:         make(chan rotateSpool),
+		sendFileChan:            make(chan sendFile),
+		acceptFileChan:          make(chan acceptFile),
+		getTransfersChan:        make(chan chan []*FileTransferInfo),
+		deleteMessageChan:       make(chan deleteMessage),
+		setRetentionChan:        make(chan setRetention),
+		eventCh:                 make(chan Event, eventSinkSize),
+		introduceChan:           make(chan introduce),
+		acceptIntroductionChan:  make(chan acceptIntroduction),
+		getIntroductionsChan:    make(chan chan []*IntroductionInfo),
+		introductions:           state.Introductions,
+		receivedIntroductions:   state.ReceivedIntroductions,
+		contacts:                make(map[uint64]*Contact),
+		contactNicknames:        make(map[string]*Contact),
+		spoolReaderChan:         state.SpoolReaderChan,
+		linkKey:                 state.LinkKey,
+		user:                    state.User,
+		inbox:                   state.Inbox,
+		inboxMutex:              new(sync.Mutex),
+		partialMessages:         state.PartialMessages,
+		sentMessages:            state.SentMessages,
+		sentMessagesMutex:       new(sync.Mutex),
+		outbox:                  state.Outbox,
+		outboxInFlight:          make(map[*outboxEntry]bool),
+		readsInFlight:           make(map[string]bool),
+		spoolRecovery:           true,
+		spoolRecoveries:         make(map[uint64]bool),
+		spoolRecoveryResultChan: make(chan spoolRecoveryResult),
+		quarantine:              state.Quarantine,
+		quarantineTimeout:       defaultQuarantineTimeout,
+		transfers:               state.Transfers,
+		downloadDir:             defaultDownloadDir,
+		spoolDrainLimit:         defaultSpoolDrainLimit,
+		readInboxResultChan:     make(chan readInboxResult),
+		spoolWriteResultChan:    make(chan spoolWriteResult),
+		stateWorker:             stateWorker,
 		readInboxPoissonTimer: poisson.NewTimer(&poisson.Descriptor{
 			Lambda: readInboxPoissonLambda,
 			Max:    readInboxPoissonMax,
 		}),
-		client:       mixnetClient,
-		session:      session,
-		spoolService: memspoolclient.New(session),
+		spoolService: spoolService,
 		log:          logBackend.GetLogger("catshadow"),
 		logBackend:   logBackend,
+
+		exportContactExchangeChan: make(chan exportContactExchange),
+		importContactExchangeChan: make(chan importContactExchange),
+		getSafetyNumberChan:       make(chan getSafetyNumber),
+		setVerifiedChan:           make(chan setVerified),
+
+		drainChan: make(chan chan error),
+		saveChan:  make(chan struct{}, 1),
 	}
 	for _, contact := range state.Contacts {
 		c.contacts[contact.id] = contact
 		c.contactNicknames[contact.nickname] = contact
 	}
-	return c, nil
+	return c
 }
 
 // Start starts the client worker goroutine and the
@@ -154,18 +289,25 @@ func New(logBackend *log.Backend, mixnetClient *client.Client, stateWorker *Stat
 func (c *Client) Start() {
 	pandaCfg := c.session.GetPandaConfig()
 	if pandaCfg == nil {
-		panic("panda failed, must have a panda service configured")
+		c.log.Warning("No PANDA service configured, contacts can only be added with a manual key exchange.")
 	}
 	for _, contact := range c.contacts {
-		if contact.isPending {
-			logPandaMeeting := c.logBackend.GetLogger(fmt.Sprintf("PANDA_meetingplace_%s", contact.nickname))
-			meetingPlace := pclient.New(pandaCfg.BlobSize, c.session, logPandaMeeting, pandaCfg.Receiver, pandaCfg.Provider)
-			logPandaKx := c.logBackend.GetLogger(fmt.Sprintf("PANDA_keyexchange_%s", contact.nickname))
-			kx, err := panda.UnmarshalKeyExchange(rand.Reader, logPandaKx, meetingPlace, contact.pandaKeyExchange)
+		if contact.isPending && contact.pandaKeyExchange != nil && contact.pandaResult == "" {
+			if pandaCfg == nil {
+				c.log.Errorf("%s: cannot resume PANDA key exchange without a PANDA service", contact.nickname)
+				continue
+			}
+			err := c.resumeKeyExchange(contact, pandaCfg)
 			if err != nil {
-				panic(err)
+				err = fmt.Errorf("failure to resume key exchange: %s", err)
+				c.log.Errorf("%s: %s", contact.nickname, err)
+				contact.pandaResult = err.Error()
+				contact.pandaKeyExchange = nil
+				c.emitEvent(&KeyExchangeFailedEvent{
+					Nickname: contact.nickname,
+					Err:      err,
+				})
 			}
-			go kx.Run()
 		}
 	}
 	c.Go(c.worker)
@@ -190,6 +332,8 @@ func (c *Client) GetLogger() *logging.Logger {
 
 // CreateRemoteSpool creates a remote spool for collecting messages
 // destined to this Client.
+//
+// Deprecated: contacts are given remote spools of their own.
 func (c *Client) CreateRemoteSpool() error {
 	desc, err := c.session.GetService(common.SpoolServiceName)
 	if err != nil {
@@ -206,15 +350,61 @@ func (c *Client) CreateRemoteSpool() error {
 	return nil
 }
 
-// NewContact adds a new contact to the Client's state. This starts
+// NewContact adds a new contact to the Client's state. This creates
+// a remote spool dedicated to the contact's messages and starts
 // the PANDA protocol instance for this contact where intermediate
 // states will be preserved in the encrypted statefile such that
 // progress on the PANDA key exchange can be continued at a later
 // time after program shutdown or restart.
 func (c *Client) NewContact(nickname string, sharedSecret []byte) {
+	spoolReaderChan, err := c.newContactSpool()
+	if err != nil {
+		c.log.Errorf("create contact failure: %s", err)
+		return
+	}
 	c.addContactChan <- addContact{
-		Name:         nickname,
-		SharedSecret: sharedSecret,
+		Name:            nickname,
+		SharedSecret:    sharedSecret,
+		SpoolReaderChan: spoolReaderChan,
+	}
+}
+
+// AddContact is like NewContact except that it waits for the
+// worker to create the contact and returns any resulting error.
+// If the context is done before the worker replies, the context's
+// error is returned and the contact may or may not be created.
+func (c *Client) AddContact(ctx context.Context, nickname string, sharedSecret []byte) error {
+	spoolReaderChan, err := c.newContactSpoolContext(ctx)
+	if err != nil {
+		return err
+	}
+	responseChan := make(chan error, 1)
+	select {
+	case c.addContactChan <- addContact{
+		Name:            nickname,
+		SharedSecret:    sharedSecret,
+		SpoolReaderChan: spoolReaderChan,
+		ResponseChan:    responseChan,
+	}:
+	case <-ctx.Done():
+		go c.purgeSpool(spoolReaderChan)
+		return ctx.Err()
+	case <-c.HaltCh():
+		go c.purgeSpool(spoolReaderChan)
+		return errHalted
+	}
+	return c.waitResponse(ctx, responseChan)
+}
+
+// waitResponse waits for the worker's reply to a synchronous command.
+func (c *Client) waitResponse(ctx context.Context, responseChan chan error) error {
+	select {
+	case err := <-responseChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.HaltCh():
+		return errHalted
 	}
 }
 
@@ -237,27 +427,52 @@ func (c *Client) randID() uint64 {
 	// unreachable
 }
 
-func (c *Client) createContact(nickname string, sharedSecret []byte) error {
+func (c *Client) createContact(nickname string, sharedSecret []byte, spoolReaderChan *channels.UnreliableSpoolReaderChannel) error {
 	if _, ok := c.contactNicknames[nickname]; ok {
+		go c.purgeSpool(spoolReaderChan)
 		return fmt.Errorf("Contact with nickname %s, already exists.", nickname)
 	}
-	contact, err := NewContact(nickname, c.randID(), c.spoolReaderChan, c.session)
+	pandaCfg := c.session.GetPandaConfig()
+	if pandaCfg == nil {
+		go c.purgeSpool(spoolReaderChan)
+		return errors.New("panda failed, must have a panda service configured")
+	}
+	contact, err := NewContact(nickname, c.randID(), spoolReaderChan, c.session)
 	if err != nil {
+		go c.purgeSpool(spoolReaderChan)
 		return err
 	}
 	c.contacts[contact.ID()] = contact
 	c.contactNicknames[contact.nickname] = contact
+	err = c.startKeyExchange(contact, sharedSecret)
+	if err != nil {
+		delete(c.contacts, contact.ID())
+		delete(c.contactNicknames, contact.nickname)
+		go c.purgeSpool(spoolReaderChan)
+		return err
+	}
+	c.retryQuarantine()
+	return nil
+}
+
+// startKeyExchange starts a PANDA key exchange with the contact
+// using the contact's double ratchet key exchange.
+func (c *Client) startKeyExchange(contact *Contact, sharedSecret []byte) error {
 	pandaCfg := c.session.GetPandaConfig()
 	if pandaCfg == nil {
 		return errors.New("panda failed, must have a panda service configured")
 	}
-	logPandaClient := c.logBackend.GetLogger(fmt.Sprintf("PANDA_meetingplace_%s", nickname))
-	meetingPlace := pclient.New(pandaCfg.BlobSize, c.session, logPandaClient, pandaCfg.Receiver, pandaCfg.Provider)
-	kxLog := c.logBackend.GetLogger(fmt.Sprintf("PANDA_keyexchange_%s", nickname))
-	kx, err := panda.NewKeyExchange(rand.Reader, kxLog, meetingPlace, sharedSecret, contact.keyExchange, contact.id, c.pandaChan, contact.pandaShutdownChan)
+	meetingPlace := c.newMeetingPlace(contact, pandaCfg)
+	kxLog := c.logBackend.GetLogger(fmt.Sprintf("PANDA_keyexchange_%s", contact.nickname))
+	random, err := newPandaRandom()
 	if err != nil {
 		return err
 	}
+	kx, err := panda.NewKeyExchange(random, kxLog, meetingPlace, sharedSecret, contact.keyExchange, contact.id, c.pandaChan, contact.pandaShutdownChan)
+	if err != nil {
+		return err
+	}
+	contact.sharedSecret = sharedSecret
 	contact.pandaKeyExchange = kx.Marshal()
 	contact.keyExchange = nil
 	go kx.Run()
@@ -267,22 +482,238 @@ func (c *Client) createContact(nickname string, sharedSecret []byte) error {
 	return nil
 }
 
+// resumeKeyExchange continues the contact's PANDA key exchange from
+// the state saved in the statefile. Like a freshly started exchange it
+// reports its progress to the worker and can be halted by closing the
+// contact's pandaShutdownChan.
+//
+// panda.UnmarshalKeyExchange doesn't take the contact ID and channels
+// which Run needs, so the exchange is recreated with NewKeyExchange
+// instead. The random bytes it consumes are replayed from the saved
+// state so that it regenerates the same DH key and messages, and it
+// repeats the meeting place exchanges already done, which return the
+// peer's messages again.
+func (c *Client) resumeKeyExchange(contact *Contact, pandaCfg *config.Panda) error {
+	saved := new(panda_proto.KeyExchange)
+	if err := proto.Unmarshal(contact.pandaKeyExchange, saved); err != nil {
+		return err
+	}
+	random, err := pandaResumeRandom(saved)
+	if err != nil {
+		return err
+	}
+	meetingPlace := c.newMeetingPlace(contact, pandaCfg)
+	kxLog := c.logBackend.GetLogger(fmt.Sprintf("PANDA_keyexchange_%s", contact.nickname))
+	contact.pandaShutdownChan = make(chan struct{})
+	kx, err := panda.NewKeyExchange(random, kxLog, meetingPlace, saved.SharedSecret, saved.KeyExchangeBytes, contact.id, c.pandaChan, contact.pandaShutdownChan)
+	if err != nil {
+		contact.pandaShutdownChan = nil
+		return err
+	}
+	go kx.Run()
+	c.log.Infof("Resumed PANDA key exchange with %s.", contact.nickname)
+	return nil
+}
+
+// newPandaRandom returns the random bytes read by a new PANDA key
+// exchange: a random DH private key followed by bytes derived from
+// it. The second message is sent before the state which holds it has
+// been saved, so a key exchange resumed from the previous state must
+// regenerate the same message.
+func newPandaRandom() (io.Reader, error) {
+	dhPrivate := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dhPrivate); err != nil {
+		return nil, err
+	}
+	return io.MultiReader(bytes.NewReader(dhPrivate), pandaStream(dhPrivate, 0)), nil
+}
+
+// pandaStream returns the bytes a PANDA key exchange reads after
+// its DH private key, starting at the given offset.
+func pandaStream(dhPrivate []byte, offset int) io.Reader {
+	h := sha3.NewShake256()
+	h.Write([]byte("catshadow PANDA key exchange"))
+	h.Write(dhPrivate)
+	io.CopyN(ioutil.Discard, h, int64(offset))
+	return h
+}
+
+// pandaResumeRandom returns the random bytes read by a PANDA key
+// exchange resuming the saved one. Key exchanges started by earlier
+// versions read random bytes rather than pandaStream, their saved
+// messages are replayed with pandaReplayBytes.
+func pandaResumeRandom(saved *panda_proto.KeyExchange) (io.Reader, error) {
+	if saved.GetStatus() == panda_proto.KeyExchange_INIT {
+		// Nothing has been sent yet.
+		return newPandaRandom()
+	}
+	replay, err := pandaReplayBytes(saved)
+	if err != nil {
+		return nil, err
+	}
+	stream := pandaStream(saved.DhPrivate, len(replay)-len(saved.DhPrivate))
+	return io.MultiReader(bytes.NewReader(replay), stream), nil
+}
+
+// pandaReplayBytes returns the random bytes a new PANDA key exchange
+// reads, in order, to reach the saved state: the DH private key, the
+// padding of the first message and the padding and nonce of the second.
+func pandaReplayBytes(saved *panda_proto.KeyExchange) ([]byte, error) {
+	if saved.GetStatus() == panda_proto.KeyExchange_INIT {
+		// The DH key is only saved once the
+		// password derivation has completed.
+		return nil, nil
+	}
+	if len(saved.DhPrivate) != 32 {
+		return nil, errors.New("saved PANDA key exchange is truncated")
+	}
+	replay := append([]byte{}, saved.DhPrivate...)
+	if len(saved.Message1) < 32 {
+		return nil, errors.New("saved PANDA key exchange is truncated")
+	}
+	replay = append(replay, saved.Message1[32:]...)
+	if saved.GetStatus() != panda_proto.KeyExchange_EXCHANGE2 {
+		return replay, nil
+	}
+	if len(saved.Message2) < 24 || len(saved.SharedKey) != 32 {
+		return nil, errors.New("saved PANDA key exchange is truncated")
+	}
+	var nonce [24]byte
+	var sharedKey [32]byte
+	copy(nonce[:], saved.Message2)
+	copy(sharedKey[:], saved.SharedKey)
+	padded, ok := secretbox.Open(nil, saved.Message2[24:], &nonce, &sharedKey)
+	if !ok || len(padded) < 4+len(saved.KeyExchangeBytes) {
+		return nil, errors.New("saved PANDA key exchange is corrupt")
+	}
+	replay = append(replay, padded[4+len(saved.KeyExchangeBytes):]...)
+	return append(replay, nonce[:]...), nil
+}
+
+func (c *Client) newMeetingPlace(contact *Contact, pandaCfg *config.Panda) *pclient.Panda {
+	logPandaClient := c.logBackend.GetLogger(fmt.Sprintf("PANDA_meetingplace_%s", contact.nickname))
+	return pclient.New(pandaCfg.BlobSize, c.session, logPandaClient, pandaCfg.Receiver, pandaCfg.Provider)
+}
+
+// RestartKeyExchange restarts the failed key exchange with the given
+// contact. A new double ratchet is created for the contact and a new
+// PANDA exchange is started, using the new shared secret if one is
+// given or else the secret used by the failed exchange.
+func (c *Client) RestartKeyExchange(ctx context.Context, nickname string, sharedSecret []byte) error {
+	responseChan := make(chan error, 1)
+	select {
+	case c.restartKxChan <- restartKeyExchange{
+		Name:         nickname,
+		SharedSecret: sharedSecret,
+		ResponseChan: responseChan,
+	}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.HaltCh():
+		return errHalted
+	}
+	return c.waitResponse(ctx, responseChan)
+}
+
+func (c *Client) doRestartKeyExchange(nickname string, sharedSecret []byte) error {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return fmt.Errorf("contact %s not found", nickname)
+	}
+	if contact.pandaResult == "" {
+		if contact.isPending {
+			return fmt.Errorf("key exchange with %s is still in progress", nickname)
+		}
+		return fmt.Errorf("key exchange with %s has already completed", nickname)
+	}
+	if len(sharedSecret) == 0 {
+		if contact.pandaResult == pclient.TagContendedError.Error() {
+			return fmt.Errorf("PANDA tag contended, a new shared secret is required for %s", nickname)
+		}
+		sharedSecret = contact.sharedSecret
+	}
+	if len(sharedSecret) == 0 {
+		return fmt.Errorf("no shared secret available for %s", nickname)
+	}
+	err := contact.resetKeyExchange(c.contactSpoolReader(contact))
+	if err != nil {
+		return err
+	}
+	// Anything still in the outbox was encrypted by the old ratchet.
+	c.removeContactOutbox(contact.id)
+	c.log.Infof("Restarting key exchange with %s.", nickname)
+	return c.startKeyExchange(contact, sharedSecret)
+}
+
 func (c *Client) GetNicknames() []string {
 	responseChan := make(chan []string)
 	c.getNicknamesChan <- responseChan
-	return <- responseChan
+	return <-responseChan
+}
+
+// GetContacts returns a snapshot of the status of each contact.
+func (c *Client) GetContacts() []*ContactInfo {
+	responseChan := make(chan []*ContactInfo)
+	c.getContactsChan <- responseChan
+	return <-responseChan
+}
+
+func (c *Client) contactInfos() []*ContactInfo {
+	received := make(map[string]int)
+	for _, message := range c.getInbox() {
+		received[message.Nickname]++
+	}
+	sent := make(map[string]int)
+	for _, message := range c.getSentMessages() {
+		sent[message.Nickname]++
+	}
+	infos := []*ContactInfo{}
+	for _, contact := range c.contacts {
+		infos = append(infos, &ContactInfo{
+			Nickname:         contact.nickname,
+			IsPending:        contact.isPending,
+			PandaStage:       contact.pandaStage(),
+			PandaResult:      contact.pandaResult,
+			ManualExchange:   contact.isPending && contact.pandaKeyExchange == nil && contact.keyExchange != nil,
+			AddedTime:        contact.addedTime,
+			MessagesReceived: received[contact.nickname],
+			MessagesSent:     sent[contact.nickname],
+			SpoolLost:        contact.spoolLost,
+			Retention:        contact.retention,
+			Verified:         contact.verified,
+		})
+	}
+	return infos
 }
 
 // RemoveContact removes a contact from the Client's state.
 func (c *Client) RemoveContact(nickname string) {
-	c.removeContactChan <- nickname
+	c.removeContactChan <- removeContact{
+		Name: nickname,
+	}
+}
+
+// DeleteContact is like RemoveContact except that it waits
+// for the worker to remove the contact and returns any error.
+func (c *Client) DeleteContact(ctx context.Context, nickname string) error {
+	responseChan := make(chan error, 1)
+	select {
+	case c.removeContactChan <- removeContact{
+		Name:         nickname,
+		ResponseChan: responseChan,
+	}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.HaltCh():
+		return errHalted
+	}
+	return c.waitResponse(ctx, responseChan)
 }
 
-func (c *Client) doContactRemoval(nickname string) {
+func (c *Client) doContactRemoval(nickname string) error {
 	contact, ok := c.contactNicknames[nickname]
 	if !ok {
-		c.log.Errorf("contact removal failed, %s not found in contacts", nickname)
-		return
+		return fmt.Errorf("contact removal failed, %s not found in contacts", nickname)
 	}
 	if contact.isPending {
 		if contact.pandaShutdownChan != nil {
@@ -291,7 +722,26 @@ func (c *Client) doContactRemoval(nickname string) {
 	}
 	delete(c.contactNicknames, nickname)
 	delete(c.contacts, contact.id)
+	c.removeContactOutbox(contact.id)
+	if contact.spoolReaderChan != nil {
+		// Stop the contact from writing to us.
+		go c.purgeSpool(contact.spoolReaderChan)
+	}
+	for _, reader := range contact.oldSpoolReaderChans {
+		go c.purgeSpool(reader)
+	}
 	c.save()
+	return nil
+}
+
+// requestSave asks the worker to save the state without waiting,
+// it is used by the methods which modify the state from the
+// caller's goroutine. Requests made while one is pending are merged.
+func (c *Client) requestSave() {
+	select {
+	case c.saveChan <- struct{}{}:
+	default:
+	}
 }
 
 func (c *Client) save() {
@@ -300,10 +750,7 @@ func (c *Client) save() {
 	if err != nil {
 		panic(err)
 	}
-	err = c.stateWorker.writeState(serialized)
-	if err != nil {
-		panic(err)
-	}
+	c.stateWorker.queueState(serialized)
 }
 
 func (c *Client) marshal() ([]byte, error) {
@@ -316,7 +763,15 @@ func (c *Client) marshal() ([]byte, error) {
 		Contacts:        contacts,
 		LinkKey:         c.linkKey,
 		User:            c.user,
-		Inbox:           c.GetInbox(),
+		Inbox:           c.getInbox(),
+		PartialMessages: c.partialMessages,
+		SentMessages:    c.getSentMessages(),
+		Outbox:          c.outbox,
+		Quarantine:      c.quarantine,
+		Transfers:       c.transfers,
+
+		Introductions:         c.introductions,
+		ReceivedIntroductions: c.receivedIntroductions,
 	}
 	var serialized []byte
 	err := codec.NewEncoderBytes(&serialized, cborHandle).Encode(s)
@@ -337,10 +792,20 @@ func (c *Client) haltKeyExchanges() {
 	}
 }
 
-// Shutdown shuts down the client.
+// ChangePassphrase re-encrypts the statefile under a new passphrase.
+func (c *Client) ChangePassphrase(oldPassphrase, newPassphrase []byte) error {
+	return c.stateWorker.Rekey(oldPassphrase, newPassphrase)
+}
+
+// Shutdown shuts down the client. The final state is written to disk
+// before the StateWriter is halted. Shutdown doesn't wait for queued
+// messages to be written to the spools, they are kept in the statefile
+// and sent once the client is started again. Use Drain beforehand to
+// wait for them.
 func (c *Client) Shutdown() {
-	c.save()
 	c.Halt()
+	c.save()
+	c.stateWorker.Halt()
 	c.session.Halt()
 }
 
@@ -358,6 +823,10 @@ func (c *Client) processPANDAUpdate(update *panda.PandaUpdate) {
 		contact.pandaKeyExchange = nil
 		contact.pandaShutdownChan = nil
 		c.log.Infof("Key exchange with %s failed: %s", contact.nickname, update.Err)
+		c.emitEvent(&KeyExchangeFailedEvent{
+			Nickname: contact.nickname,
+			Err:      update.Err,
+		})
 	case update.Serialised != nil:
 		if bytes.Equal(contact.pandaKeyExchange, update.Serialised) {
 			c.log.Infof("Strange, our PANDA key exchange echoed our exchange bytes: %s", contact.nickname)
@@ -367,55 +836,300 @@ func (c *Client) processPANDAUpdate(update *panda.PandaUpdate) {
 	case update.Result != nil:
 		c.log.Debug("PANDA exchange completed")
 		contact.pandaKeyExchange = nil
-		exchange, err := parseContactExchangeBytes(update.Result)
-		if err != nil {
-			err = fmt.Errorf("failure to parse contact exchange bytes: %s", err)
-			c.log.Error(err.Error())
-			contact.pandaResult = err.Error()
-		}
-		contact.spoolWriterChan = exchange.SpoolWriter
-		err = contact.ratchet.ProcessKeyExchange(exchange.SignedKeyExchange)
-		if err != nil {
-			err = fmt.Errorf("Double ratchet key exchange failure: %s", err)
-			c.log.Error(err.Error())
-			contact.pandaResult = err.Error()
-		}
-		contact.isPending = false
-		c.log.Debug("Double ratchet key exchange completed!")
+		c.completeKeyExchange(contact, update.Result)
 	}
 	c.save()
 }
 
-// SendMessage sends a message to the Client contact with the given nickname.
-func (c *Client) SendMessage(nickname string, message []byte) {
+// completeKeyExchange processes the contact exchange bytes received
+// from the contact, through PANDA or otherwise, and emits an event
+// reporting the outcome of the key exchange.
+func (c *Client) completeKeyExchange(contact *Contact, exchangeBytes []byte) {
+	exchange, err := parseContactExchangeBytes(exchangeBytes)
+	if err != nil {
+		err = fmt.Errorf("failure to parse contact exchange bytes: %s", err)
+		c.log.Error(err.Error())
+		contact.pandaResult = err.Error()
+		c.emitEvent(&KeyExchangeFailedEvent{
+			Nickname: contact.nickname,
+			Err:      err,
+		})
+		return
+	}
+	contact.spoolWriterChan = exchange.SpoolWriter
+	contact.peerVersion = legacyProtocolVersion
+	contact.setPeerVersion(exchange.Version)
+	err = contact.ratchet.ProcessKeyExchange(exchange.SignedKeyExchange)
+	if err != nil {
+		err = fmt.Errorf("Double ratchet key exchange failure: %s", err)
+		c.log.Error(err.Error())
+		contact.pandaResult = err.Error()
+		c.emitEvent(&KeyExchangeFailedEvent{
+			Nickname: contact.nickname,
+			Err:      err,
+		})
+	} else {
+		contact.sharedSecret = nil
+		c.emitEvent(&KeyExchangeCompletedEvent{
+			Nickname: contact.nickname,
+		})
+	}
+	contact.isPending = false
+	c.log.Debug("Double ratchet key exchange completed!")
+	c.retryQuarantine()
+}
+
+// SendMessage sends a message to the Client contact with the given nickname
+// and returns the ID of the message which can be used to track its delivery
+// status. Messages larger than a single double ratchet payload are split into
+// fragments which are reassembled by the recipient.
+func (c *Client) SendMessage(nickname string, message []byte) MessageID {
+	id := c.queueMessage(nickname, message)
 	c.sendMessageChan <- sendMessage{
+		ID:      id,
 		Name:    nickname,
 		Payload: message,
 	}
+	return id
+}
+
+// Send is like SendMessage except that it waits for the worker to
+// encrypt the message and queue it to be written to the contact's
+// spool. The returned error reports why the message could not be sent,
+// failed spool writes are retried and are reported through the event
+// sink.
+func (c *Client) Send(ctx context.Context, nickname string, message []byte) (MessageID, error) {
+	id := c.queueMessage(nickname, message)
+	responseChan := make(chan error, 1)
+	select {
+	case c.sendMessageChan <- sendMessage{
+		ID:           id,
+		Name:         nickname,
+		Payload:      message,
+		ResponseChan: responseChan,
+	}:
+	case <-ctx.Done():
+		c.removeSentMessage(id)
+		return id, ctx.Err()
+	case <-c.HaltCh():
+		c.removeSentMessage(id)
+		return id, errHalted
+	}
+	return id, c.waitResponse(ctx, responseChan)
+}
+
+// queueMessage records a new message with the queued
+// status and returns its ID.
+func (c *Client) queueMessage(nickname string, message []byte) MessageID {
+	id := newMessageID()
+	c.sentMessagesMutex.Lock()
+	defer c.sentMessagesMutex.Unlock()
+	c.sentMessages = append(c.sentMessages, &SentMessage{
+		ID:        id,
+		Nickname:  nickname,
+		Plaintext: append([]byte(nil), message...),
+		Status:    MessageQueued,
+		SentTime:  time.Now(),
+	})
+	return id
+}
+
+func (c *Client) removeSentMessage(id MessageID) {
+	c.sentMessagesMutex.Lock()
+	defer c.sentMessagesMutex.Unlock()
+	sent := make([]*SentMessage, 0, len(c.sentMessages))
+	for _, m := range c.sentMessages {
+		if m.ID != id {
+			sent = append(sent, m)
+		}
+	}
+	c.sentMessages = sent
 }
 
-func (c *Client) doSendMessage(nickname string, message []byte) {
+func (c *Client) doSendMessage(id MessageID, nickname string, message []byte) error {
+	defer c.save()
 	contact, ok := c.contactNicknames[nickname]
 	if !ok {
-		c.log.Errorf("contact %s not found", nickname)
-		return
+		err := fmt.Errorf("contact %s not found", nickname)
+		c.failMessage(id, nickname, err)
+		return err
 	}
 	if contact.isPending {
-		c.log.Errorf("cannot send message, contact %s is pending a key exchange", nickname)
-		return
+		err := fmt.Errorf("cannot send message, contact %s is pending a key exchange", nickname)
+		c.failMessage(id, nickname, err)
+		return err
+	}
+	err := c.sendPayload(contact, messageTypeText, id, message)
+	if err != nil {
+		err = fmt.Errorf("failure to send message to %s: %s", nickname, err)
+		c.failMessage(id, nickname, err)
+		return err
+	}
+	return nil
+}
+
+// failMessage marks the message as failed and notifies the application.
+func (c *Client) failMessage(id MessageID, nickname string, err error) {
+	c.setMessageStatus(id, MessageFailed)
+	c.emitEvent(&MessageSentEvent{
+		Nickname:  nickname,
+		MessageID: id,
+		Err:       err,
+	})
+}
+
+// encodePayload returns the padded double ratchet payloads carrying
+// the message, which are envelopes unless the contact only supports
+// the baseline format, in which case the message must be a text
+// message fitting in a single payload.
+func (c *Client) encodePayload(contact *Contact, messageType uint8, id MessageID, payload []byte) ([][]byte, error) {
+	if contact.peerVersion >= envelopeVersion {
+		return newEnvelope(messageType, id, payload).payloads()
+	}
+	if messageType != messageTypeText {
+		return nil, fmt.Errorf("%s does not support message type %d", contact.nickname, messageType)
 	}
+	if len(payload) > channels.DoubleRatchetPayloadLength-4 {
+		return nil, fmt.Errorf("%s does not support messages larger than %d bytes", contact.nickname, channels.DoubleRatchetPayloadLength-4)
+	}
+	return [][]byte{padPayload(payload)}, nil
+}
 
-	payload := [channels.DoubleRatchetPayloadLength]byte{}
-	binary.BigEndian.PutUint32(payload[:4], uint32(len(message)))
-	copy(payload[4:], message)
-	ciphertext := contact.ratchet.Encrypt(nil, payload[:])
+// sendPayload splits the payload into fragments, encrypts each of them
+// with the contact's double ratchet and places them in the outbox to be
+// written to the contact's spool by spool write jobs. Failed spool writes
+// are left in the outbox to be retried, only errors which prevent the
+// payload from being sent at all are returned.
+func (c *Client) sendPayload(contact *Contact, messageType uint8, id MessageID, payload []byte) error {
+	err := c.queuePayload(contact, messageType, id, payload)
+	if err != nil {
+		return err
+	}
 	c.save()
+	c.flushOutbox()
+	return nil
+}
 
-	err := contact.spoolWriterChan.Write(c.spoolService, ciphertext)
+// queuePayload is like sendPayload except that the caller must
+// save the state and flush the outbox once it is done queuing.
+func (c *Client) queuePayload(contact *Contact, messageType uint8, id MessageID, payload []byte) error {
+	plaintexts, err := c.encodePayload(contact, messageType, id, payload)
 	if err != nil {
-		c.log.Errorf("double ratchet channel write failure: %s", err)
+		return err
 	}
-	c.log.Info("Sent message to %s.", nickname)
+	entries := []*outboxEntry{}
+	for _, plaintext := range plaintexts {
+		entries = append(entries, &outboxEntry{
+			ContactID:  contact.id,
+			MessageID:  id,
+			Ciphertext: contact.ratchet.Encrypt(nil, plaintext),
+		})
+	}
+	c.outbox = append(c.outbox, entries...)
+	return nil
+}
+
+// sendAck acknowledges the delivery of the given message to the
+// contact, unless the contact doesn't support acknowledgements.
+func (c *Client) sendAck(contact *Contact, id MessageID) {
+	if contact.peerVersion < envelopeVersion {
+		return
+	}
+	body := [8]byte{}
+	binary.BigEndian.PutUint64(body[:], uint64(id))
+	err := c.sendPayload(contact, messageTypeAck, newMessageID(), body[:])
+	if err != nil {
+		c.log.Errorf("failure to acknowledge message %s from %s: %s", id, contact.nickname, err)
+	}
+}
+
+func (c *Client) processAck(contact *Contact, body []byte) {
+	if len(body) != 8 {
+		c.log.Errorf("received invalid acknowledgement from %s", contact.nickname)
+		return
+	}
+	id := MessageID(binary.BigEndian.Uint64(body))
+	if c.processRotationAck(contact, id) {
+		return
+	}
+	c.sentMessagesMutex.Lock()
+	defer c.sentMessagesMutex.Unlock()
+	for _, m := range c.sentMessages {
+		if m.ID == id && m.Nickname == contact.nickname {
+			m.Status = MessageDelivered
+			m.DeliveredTime = time.Now()
+			c.log.Infof("Message %s was delivered to %s.", id, contact.nickname)
+			c.emitEvent(&MessageDeliveredEvent{
+				Nickname:  contact.nickname,
+				MessageID: id,
+			})
+			return
+		}
+	}
+	c.log.Debugf("received acknowledgement of unknown message %s from %s", id, contact.nickname)
+}
+
+// setMessageStatus updates the status of the sent message and returns
+// false if the ID doesn't belong to a message sent by the user.
+func (c *Client) setMessageStatus(id MessageID, status MessageStatus) bool {
+	c.sentMessagesMutex.Lock()
+	defer c.sentMessagesMutex.Unlock()
+	for _, m := range c.sentMessages {
+		if m.ID == id {
+			m.Status = status
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) isSentMessage(id MessageID) bool {
+	c.sentMessagesMutex.Lock()
+	defer c.sentMessagesMutex.Unlock()
+	for _, m := range c.sentMessages {
+		if m.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) getSentMessages() []*SentMessage {
+	c.sentMessagesMutex.Lock()
+	defer c.sentMessagesMutex.Unlock()
+	sent := make([]*SentMessage, len(c.sentMessages))
+	for i, message := range c.sentMessages {
+		m := *message
+		sent[i] = &m
+	}
+	return sent
+}
+
+// GetSentMessages returns a copy of the delivery status of each
+// message we have sent, along with a copy of its plaintext.
+func (c *Client) GetSentMessages() []*SentMessage {
+	c.sentMessagesMutex.Lock()
+	defer c.sentMessagesMutex.Unlock()
+	sent := make([]*SentMessage, len(c.sentMessages))
+	for i, m := range c.sentMessages {
+		message := *m
+		message.Plaintext = append([]byte(nil), m.Plaintext...)
+		sent[i] = &message
+	}
+	return sent
+}
+
+// GetMessageStatus returns the delivery status of the sent
+// message with the given ID.
+func (c *Client) GetMessageStatus(id MessageID) (MessageStatus, error) {
+	c.sentMessagesMutex.Lock()
+	defer c.sentMessagesMutex.Unlock()
+	for _, m := range c.sentMessages {
+		if m.ID == id {
+			return m.Status, nil
+		}
+	}
+	return 0, fmt.Errorf("message %s not found", id)
 }
 
 func (c *Client) DoSendDropMsg() {
@@ -426,53 +1140,248 @@ func (c *Client) DoSendDropMsg() {
 	c.log.Info("Sent DIRECT drop decoy message")
 }
 
+// SetSpoolDrainLimit sets the maximum number of messages read from the
+// remote spool each time it is polled. A backlog larger than this is
+// read over subsequent polls. It must be called before Start.
+func (c *Client) SetSpoolDrainLimit(limit int) {
+	if limit < 1 {
+		limit = 1
+	}
+	c.spoolDrainLimit = limit
+}
+
 func (c *Client) SetLambdaP(lambdaP float64, lambdaPMax uint64) {
 	c.session.SetLambdaP(lambdaP, lambdaPMax)
 }
 
-// GetInbox returns the Client's inbox.
-func (c *Client) GetInbox() []*Message {
-	c.inboxMutex.Lock()
-	defer c.inboxMutex.Unlock()
-	return c.inbox
+// decryptMessage decrypts the ciphertext read from the spool of the
+// contact with the given ID, or from the shared spool, and processes
+// the decrypted fragment. Ciphertexts which can't be decrypted are
+// quarantined and false is returned.
+func (c *Client) decryptMessage(contactID uint64, ciphertext []byte) bool {
+	if !c.tryDecryptMessage(contactID, ciphertext) {
+		c.log.Debug("failure to find ratchet which will decrypt this message")
+		c.quarantineMessage(contactID, ciphertext)
+		return false
+	}
+	c.retryContactQuarantine(contactID)
+	return true
+}
+
+// tryDecryptMessage returns false if the ciphertext can't be decrypted.
+// Messages read from a contact's spool are decrypted with that contact's
+// ratchet, whereas those read from the shared spool are trial decrypted
+// with the ratchets of the contacts which write to the shared spool.
+func (c *Client) tryDecryptMessage(contactID uint64, ciphertext []byte) bool {
+	if contactID != sharedSpoolID {
+		contact, ok := c.contacts[contactID]
+		if !ok {
+			return false
+		}
+		return c.decryptContactMessage(contact, ciphertext)
+	}
+	for _, contact := range c.contacts {
+		if !contact.readsSharedSpool() {
+			continue
+		}
+		if c.decryptContactMessage(contact, ciphertext) {
+			return true
+		}
+	}
+	return false
 }
 
-func (c *Client) readInbox() bool {
-	var err error
-	ciphertext, err := c.spoolReaderChan.Read(c.spoolService)
+// decryptContactMessage returns false if the contact's ratchet fails
+// to decrypt. A ciphertext which was already decrypted is dropped.
+func (c *Client) decryptContactMessage(contact *Contact, ciphertext []byte) bool {
+	if contact.isDuplicate(ciphertext) {
+		c.log.Debugf("dropping duplicate message from %s", contact.nickname)
+		return true
+	}
+	plaintext, err := contact.ratchet.Decrypt(ciphertext)
 	if err != nil {
-		c.log.Debugf("failure reading remote spool: %s", err)
 		return false
 	}
-	message := Message{}
-	var decrypted bool
-	for _, contact := range c.contacts {
-		plaintext, err := contact.ratchet.Decrypt(ciphertext)
+	contact.addDecrypted(ciphertext)
+	err = c.processPayload(contact, plaintext)
+	if err != nil {
+		c.log.Errorf("failure to decode message from %s: %s", contact.nickname, err)
+	}
+	return true
+}
+
+// processPayload decodes a decrypted double ratchet payload, which is
+// either an envelope or a text message in the baseline format.
+func (c *Client) processPayload(contact *Contact, payload []byte) error {
+	format, err := payloadFormat(payload)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case payloadFormatBaseline:
+		message, err := unpadPayload(payload)
 		if err != nil {
-			continue
-		} else {
-			decrypted = true
-			message.Nickname = contact.nickname
-			payloadLen := binary.BigEndian.Uint32(plaintext[:4])
-			message.Plaintext = plaintext[4 : 4+payloadLen]
-			message.ReceivedTime = time.Now()
+			return err
+		}
+		c.processMessage(contact, messageTypeText, newMessageID(), message, time.Time{})
+		return nil
+	case payloadFormatEnvelope:
+		plaintext, err := unpadEnvelope(payload)
+		if err != nil {
+			return err
+		}
+		e, err := decodeEnvelope(plaintext)
+		if err != nil {
+			return err
+		}
+		return c.processEnvelope(contact, e)
+	default:
+		return fmt.Errorf("unknown payload format %d", format)
+	}
+}
+
+// processEnvelope handles a decoded envelope according to its type.
+func (c *Client) processEnvelope(contact *Contact, e *envelope) error {
+	// A contact sending envelopes understands them.
+	contact.setPeerVersion(e.Version)
+	if e.Type == messageTypeFragment {
+		f, err := e.fragment()
+		if err != nil {
+			return err
+		}
+		c.processFragment(contact, f)
+		return nil
+	}
+	c.processMessage(contact, e.Type, e.ID, e.Body, e.sentTime())
+	return nil
+}
+
+// processFragment adds the fragment to the partial message store
+// and delivers the message to the inbox once it is complete.
+func (c *Client) processFragment(contact *Contact, f *fragment) {
+	if f.Count == 1 {
+		c.processReassembled(contact, f.Data)
+		return
+	}
+	var partial *partialMessage
+	for _, p := range c.partialMessages {
+		if p.ContactID == contact.id && p.MessageID == f.MessageID {
+			partial = p
 			break
 		}
 	}
-	if decrypted {
-		c.inboxMutex.Lock()
-		defer c.inboxMutex.Unlock()
-		c.inbox = append(c.inbox, &message)
-		return true
+	if partial == nil {
+		partial = newPartialMessage(contact.id, f)
+		c.partialMessages = append(c.partialMessages, partial)
 	}
-	c.log.Debugf("failure to find ratchet which will decrypt this message: %s", err)
-	return false
+	complete, err := partial.add(f)
+	if err != nil {
+		c.log.Errorf("failure to reassemble message from %s: %s", contact.nickname, err)
+		return
+	}
+	c.log.Debugf("received fragment %d of %d from %s", f.Index+1, f.Count, contact.nickname)
+	if complete {
+		c.removePartialMessage(partial)
+		c.processReassembled(contact, partial.reassemble())
+	}
+}
+
+// processReassembled handles the encoded envelope
+// reassembled from fragment envelopes.
+func (c *Client) processReassembled(contact *Contact, body []byte) {
+	e, err := decodeEnvelope(body)
+	if err == nil && e.Type == messageTypeFragment {
+		err = errors.New("nested fragment envelope")
+	}
+	if err != nil {
+		c.log.Errorf("failure to decode reassembled envelope from %s: %s", contact.nickname, err)
+		return
+	}
+	c.processEnvelope(contact, e)
 }
 
-// worker goroutine takes ownership of our contacts
+// processMessage handles a reassembled message according to its
+// type. The sent time is zero for messages in the legacy formats.
+func (c *Client) processMessage(contact *Contact, messageType uint8, id MessageID, body []byte, sentTime time.Time) {
+	switch messageType {
+	case messageTypeText:
+		c.deliverMessage(contact, body, sentTime)
+		c.sendAck(contact, id)
+	case messageTypeAck:
+		c.processAck(contact, body)
+	case messageTypeControl:
+		c.processControlMessage(contact, body)
+		c.sendAck(contact, id)
+	case messageTypeFile:
+		c.processFileMessage(contact, body)
+	case messageTypeIntroduction:
+		c.processIntroductionMessage(contact, body)
+	default:
+		c.log.Errorf("received message of unknown type %d from %s", messageType, contact.nickname)
+	}
+}
+
+func (c *Client) removePartialMessage(partial *partialMessage) {
+	for i, p := range c.partialMessages {
+		if p == partial {
+			c.partialMessages = append(c.partialMessages[:i], c.partialMessages[i+1:]...)
+			return
+		}
+	}
+}
+
+// expirePartialMessages discards incomplete messages whose
+// remaining fragments never arrived and returns true if any
+// were discarded.
+func (c *Client) expirePartialMessages() bool {
+	now := time.Now()
+	partials := []*partialMessage{}
+	for _, p := range c.partialMessages {
+		if p.isExpired(now) {
+			c.log.Warningf("discarding incomplete message %d, received %d of %d fragments", p.MessageID, p.Received, len(p.Fragments))
+			continue
+		}
+		partials = append(partials, p)
+	}
+	expired := len(partials) != len(c.partialMessages)
+	c.partialMessages = partials
+	return expired
+}
+
+func (c *Client) deliverMessage(contact *Contact, plaintext []byte, sentTime time.Time) {
+	message := &Message{
+		ID:           newMessageID(),
+		Nickname:     contact.nickname,
+		Plaintext:    plaintext,
+		ReceivedTime: time.Now(),
+		SentTime:     sentTime,
+	}
+	c.inboxMutex.Lock()
+	c.inbox = append(c.inbox, message)
+	c.inboxMutex.Unlock()
+	c.emitEvent(&MessageReceivedEvent{
+		Nickname:     message.Nickname,
+		MessageID:    message.ID,
+		Message:      append([]byte(nil), message.Plaintext...),
+		ReceivedTime: message.ReceivedTime,
+		SentTime:     message.SentTime,
+	})
+}
+
+// worker goroutine takes ownership of our contacts. The mixnet
+// round trips to the remote spools are performed by jobs running
+// in their own goroutines whose results are posted back to the
+// worker, so that the state is only ever modified by the worker.
 func (c *Client) worker() {
 	c.readInboxPoissonTimer.Start()
 	defer c.readInboxPoissonTimer.Stop()
+	outboxTicker := time.NewTicker(outboxRetryInterval)
+	defer outboxTicker.Stop()
+	retentionTicker := time.NewTicker(retentionCheckInterval)
+	defer retentionTicker.Stop()
+	if c.expireMessages() {
+		c.save()
+	}
 	for {
 		select {
 		case <-c.HaltCh():
@@ -480,27 +1389,153 @@ func (c *Client) worker() {
 			c.haltKeyExchanges()
 			return
 		case <-c.readInboxPoissonTimer.Channel():
-			if c.readInbox() {
+			c.readInbox()
+			expired := c.expirePartialMessages()
+			expired = c.expireQuarantine() || expired
+			expired = c.expireIntroductions() || expired
+			expired = c.expireFileOffers() || expired
+			if c.resumeTransfers() || expired {
 				c.save()
 			}
 			c.readInboxPoissonTimer.Next()
+		case result := <-c.readInboxResultChan:
+			if c.processReadInboxResult(result) {
+				c.save()
+			}
+		case result := <-c.spoolWriteResultChan:
+			c.processSpoolWriteResult(result)
+			c.save()
+			c.notifyDrained()
+		case <-c.saveChan:
+			c.save()
+		case responseChan := <-c.drainChan:
+			c.drainWaiters = append(c.drainWaiters, responseChan)
+			c.flushOutbox()
+			c.notifyDrained()
+		case result := <-c.spoolRecoveryResultChan:
+			c.processSpoolRecoveryResult(result)
+		case <-outboxTicker.C:
+			c.flushOutbox()
+			c.notifyDrained()
+		case <-retentionTicker.C:
+			if c.expireMessages() {
+				c.save()
+			}
 		case addContact := <-c.addContactChan:
-			err := c.createContact(addContact.Name, addContact.SharedSecret)
+			var err error
+			if addContact.Manual {
+				err = c.createManualContact(addContact.Name, addContact.SpoolReaderChan)
+			} else {
+				err = c.createContact(addContact.Name, addContact.SharedSecret, addContact.SpoolReaderChan)
+			}
 			if err != nil {
 				c.log.Errorf("create contact failure: %s", err.Error())
 			}
-		case responseChan := <- c.getNicknamesChan:
+			if addContact.ResponseChan != nil {
+				addContact.ResponseChan <- err
+			}
+		case responseChan := <-c.getNicknamesChan:
 			names := []string{}
 			for contact := range c.contactNicknames {
 				names = append(names, contact)
 			}
 			responseChan <- names
+		case responseChan := <-c.getContactsChan:
+			responseChan <- c.contactInfos()
+		case responseChan := <-c.getTransfersChan:
+			responseChan <- c.transferInfos()
+		case responseChan := <-c.getIntroductionsChan:
+			responseChan <- c.introductionInfos()
+		case export := <-c.exportContactExchangeChan:
+			exchange, err := c.doExportContactExchange(export.Name)
+			export.ResponseChan <- contactExchangeResult{
+				Exchange: exchange,
+				Err:      err,
+			}
+		case importExchange := <-c.importContactExchangeChan:
+			err := c.doImportContactExchange(importExchange.Name, importExchange.Exchange)
+			if err != nil {
+				c.log.Error(err.Error())
+			}
+			importExchange.ResponseChan <- err
+		case getSafetyNumber := <-c.getSafetyNumberChan:
+			_, number, err := c.contactSafetyNumber(getSafetyNumber.Name)
+			getSafetyNumber.ResponseChan <- safetyNumberResult{
+				SafetyNumber: number,
+				Err:          err,
+			}
+		case setVerified := <-c.setVerifiedChan:
+			err := c.doSetVerified(setVerified.Name, setVerified.SafetyNumber, setVerified.Verified)
+			if err != nil {
+				c.log.Error(err.Error())
+			}
+			setVerified.ResponseChan <- err
+		case introduce := <-c.introduceChan:
+			err := c.doIntroduce(introduce.Names)
+			if err != nil {
+				c.log.Error(err.Error())
+			}
+			introduce.ResponseChan <- err
+		case accept := <-c.acceptIntroductionChan:
+			err := c.doAcceptIntroduction(accept.ID, accept.Name, accept.SpoolReaderChan)
+			if err != nil {
+				c.log.Error(err.Error())
+			}
+			accept.ResponseChan <- err
+		case sendFile := <-c.sendFileChan:
+			err := c.doSendFile(sendFile.ID, sendFile.Name, sendFile.FileName, sendFile.Data)
+			if err != nil {
+				c.log.Error(err.Error())
+			}
+			sendFile.ResponseChan <- err
+		case setRetention := <-c.setRetentionChan:
+			err := c.doSetRetention(setRetention.Name, setRetention.Retention, setRetention.Notify)
+			if err != nil {
+				c.log.Error(err.Error())
+			}
+			setRetention.ResponseChan <- err
+		case deleteMessage := <-c.deleteMessageChan:
+			err := c.doDeleteMessage(deleteMessage.ID)
+			if err != nil {
+				c.log.Error(err.Error())
+			}
+			deleteMessage.ResponseChan <- err
+		case acceptFile := <-c.acceptFileChan:
+			err := c.doAcceptFile(acceptFile.ID)
+			if err != nil {
+				c.log.Error(err.Error())
+			}
+			acceptFile.ResponseChan <- err
 		case update := <-c.pandaChan:
 			c.processPANDAUpdate(&update)
 		case sendMessage := <-c.sendMessageChan:
-			c.doSendMessage(sendMessage.Name, sendMessage.Payload)
-		case nickname := <-c.removeContactChan:
-			c.doContactRemoval(nickname)
+			err := c.doSendMessage(sendMessage.ID, sendMessage.Name, sendMessage.Payload)
+			if err != nil {
+				c.log.Error(err.Error())
+			}
+			if sendMessage.ResponseChan != nil {
+				sendMessage.ResponseChan <- err
+			}
+		case restartKx := <-c.restartKxChan:
+			err := c.doRestartKeyExchange(restartKx.Name, restartKx.SharedSecret)
+			if err != nil {
+				c.log.Error(err.Error())
+			}
+			restartKx.ResponseChan <- err
+		case rotateSpool := <-c.rotateSpoolChan:
+			err := c.doRotateSpool(rotateSpool.Name, rotateSpool.SpoolReaderChan)
+			if err != nil {
+				c.log.Error(err.Error())
+			}
+			rotateSpool.ResponseChan <- err
+		case removeContact := <-c.removeContactChan:
+			err := c.doContactRemoval(removeContact.Name)
+			if err != nil {
+				c.log.Error(err.Error())
+			}
+			if removeContact.ResponseChan != nil {
+				removeContact.ResponseChan <- err
+			}
 		}
 	}
 }
@@ -0,0 +1,378 @@
+// client_test.go - test clients sharing an in-memory spool service
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/katzenpost/client/utils"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/memspool/common"
+	panda_proto "github.com/katzenpost/panda/crypto/proto"
+)
+
+// errTestMixnet is returned by the fakeSpoolService
+// for the spool writes it was told to fail.
+var errTestMixnet = errors.New("mixnet round trip timed out")
+
+// fakeSpoolService is an in-memory spool service which replies
+// like the spool service of a Provider. It is shared by the test
+// clients, each of which stands in for its own worker.
+type fakeSpoolService struct {
+	sync.Mutex
+
+	spools     map[string][][]byte
+	failWrites int
+	writes     int
+	created    int
+
+	// createBlock and writeBlock, if set, delay spool
+	// creation and spool writes until they are closed.
+	createBlock chan struct{}
+	writeBlock  chan struct{}
+}
+
+func newFakeSpoolService() *fakeSpoolService {
+	return &fakeSpoolService{
+		spools: make(map[string][][]byte),
+	}
+}
+
+func spoolFailure(status string) error {
+	return fmt.Errorf("spool command failure: %s", status)
+}
+
+func (s *fakeSpoolService) CreateSpool(privKey *eddsa.PrivateKey, spoolReceiver string, spoolProvider string) ([]byte, error) {
+	if s.createBlock != nil {
+		<-s.createBlock
+	}
+	s.Lock()
+	defer s.Unlock()
+	spoolID := make([]byte, common.SpoolIDSize)
+	if _, err := rand.Reader.Read(spoolID); err != nil {
+		return nil, err
+	}
+	s.spools[string(spoolID)] = [][]byte{}
+	s.created++
+	return spoolID, nil
+}
+
+func (s *fakeSpoolService) ReadFromSpool(spoolID []byte, messageID uint32, privKey *eddsa.PrivateKey, spoolReceiver string, spoolProvider string) (*common.SpoolResponse, error) {
+	s.Lock()
+	defer s.Unlock()
+	spool, ok := s.spools[string(spoolID)]
+	if !ok {
+		return nil, spoolFailure("spool not found")
+	}
+	if messageID == 0 || int(messageID) > len(spool) {
+		return nil, spoolFailure(spoolNoMessageStatus)
+	}
+	return &common.SpoolResponse{
+		SpoolID: spoolID,
+		Message: spool[messageID-1],
+		Status:  "OK",
+	}, nil
+}
+
+func (s *fakeSpoolService) AppendToSpool(spoolID []byte, message []byte, spoolReceiver string, spoolProvider string) error {
+	if s.writeBlock != nil {
+		<-s.writeBlock
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.failWrites > 0 {
+		s.failWrites--
+		return errTestMixnet
+	}
+	spool, ok := s.spools[string(spoolID)]
+	if !ok {
+		return spoolFailure("spool not found")
+	}
+	s.spools[string(spoolID)] = append(spool, message)
+	s.writes++
+	return nil
+}
+
+func (s *fakeSpoolService) PurgeSpool(spoolID []byte, privKey *eddsa.PrivateKey, recipient, provider string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.spools[string(spoolID)]; !ok {
+		return spoolFailure("spool not found")
+	}
+	delete(s.spools, string(spoolID))
+	return nil
+}
+
+// spool returns a copy of the messages in the spool.
+func (s *fakeSpoolService) spool(spoolID []byte) [][]byte {
+	s.Lock()
+	defer s.Unlock()
+	return append([][]byte{}, s.spools[string(spoolID)]...)
+}
+
+// hasSpool returns true if the spool exists.
+func (s *fakeSpoolService) hasSpool(spoolID []byte) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.spools[string(spoolID)]
+	return ok
+}
+
+// counts returns the number of spools created
+// and the number of spools which still exist.
+func (s *fakeSpoolService) counts() (int, int) {
+	s.Lock()
+	defer s.Unlock()
+	return s.created, len(s.spools)
+}
+
+// duplicateLast writes the last message of the spool a second time,
+// as a retried write whose first reply was lost does.
+func (s *fakeSpoolService) duplicateLast(spoolID []byte) {
+	s.Lock()
+	defer s.Unlock()
+	spool := s.spools[string(spoolID)]
+	s.spools[string(spoolID)] = append(spool, spool[len(spool)-1])
+}
+
+// moveLastToFront moves the last message of the spool
+// to the front, delivering it ahead of the others.
+func (s *fakeSpoolService) moveLastToFront(spoolID []byte) {
+	s.Lock()
+	defer s.Unlock()
+	spool := s.spools[string(spoolID)]
+	last := spool[len(spool)-1]
+	s.spools[string(spoolID)] = append([][]byte{last}, spool[:len(spool)-1]...)
+}
+
+// newTestClient returns a Client of the given user which uses the fake
+// spool service. Its worker isn't started, the test drives the Client.
+func newTestClient(t *testing.T, user string, spools *fakeSpoolService) *Client {
+	logBackend, err := log.New(os.DevNull, "ERROR", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &State{
+		User:    user,
+		LinkKey: linkKey,
+	}
+	stateWorker := &StateWriter{
+		log:     testLog,
+		stateCh: make(chan []byte, 1),
+	}
+	c := newClient(logBackend, stateWorker, state, spools)
+	c.spoolDescriptor = func() (*utils.ServiceDescriptor, error) {
+		return &utils.ServiceDescriptor{
+			Name:     "spool",
+			Provider: "provider",
+		}, nil
+	}
+	return c
+}
+
+// pairTestClients completes a manual key exchange between the two
+// clients, each of which names the other after the other's user.
+func pairTestClients(t *testing.T, a, b *Client) {
+	addContact := func(c *Client, nickname string) []byte {
+		spoolReaderChan, err := c.newContactSpool()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.createManualContact(nickname, spoolReaderChan); err != nil {
+			t.Fatal(err)
+		}
+		exchange, err := c.doExportContactExchange(nickname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exchange
+	}
+	aExchange := addContact(a, b.user)
+	bExchange := addContact(b, a.user)
+	if err := a.doImportContactExchange(b.user, bExchange); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.doImportContactExchange(a.user, aExchange); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sendTestMessage sends a text message as SendMessage does.
+func sendTestMessage(t *testing.T, c *Client, nickname, message string) MessageID {
+	id := c.queueMessage(nickname, []byte(message))
+	if err := c.doSendMessage(id, nickname, []byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// settle processes the results of the client's spool jobs
+// as the worker does, until no job is left running.
+func settle(c *Client) {
+	for len(c.readsInFlight) > 0 || len(c.outboxInFlight) > 0 || len(c.spoolRecoveries) > 0 {
+		select {
+		case result := <-c.readInboxResultChan:
+			c.processReadInboxResult(result)
+		case result := <-c.spoolWriteResultChan:
+			c.processSpoolWriteResult(result)
+		case result := <-c.spoolRecoveryResultChan:
+			c.processSpoolRecoveryResult(result)
+		}
+	}
+}
+
+// poll reads the client's spools as the worker does
+// when its timer fires, and waits for the reads.
+func poll(c *Client) {
+	c.readInbox()
+	settle(c)
+}
+
+// exchangeMessages polls the clients until they have
+// read every message and acknowledgement in their spools.
+func exchangeMessages(clients ...*Client) {
+	for i := 0; i < 3; i++ {
+		for _, c := range clients {
+			poll(c)
+		}
+	}
+}
+
+// inboxText returns the text of the messages in the client's inbox.
+func inboxText(c *Client) []string {
+	text := []string{}
+	for _, m := range c.GetInbox() {
+		text = append(text, string(m.Plaintext))
+	}
+	return text
+}
+
+// waitEvent returns the first pending event for which match returns true.
+func waitEvent(t *testing.T, c *Client, match func(Event) bool) Event {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e := <-c.eventCh:
+			if match(e) {
+				return e
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for an event")
+		}
+	}
+}
+
+func TestClientMessageExchange(t *testing.T) {
+	spools := newFakeSpoolService()
+	alice := newTestClient(t, "alice", spools)
+	bob := newTestClient(t, "bob", spools)
+	pairTestClients(t, alice, bob)
+
+	id := sendTestMessage(t, alice, "bob", "hello bob")
+	settle(alice)
+	exchangeMessages(bob, alice)
+
+	if text := inboxText(bob); len(text) != 1 || text[0] != "hello bob" {
+		t.Fatalf("got inbox %q", text)
+	}
+	e := waitEvent(t, bob, func(e Event) bool {
+		_, ok := e.(*MessageReceivedEvent)
+		return ok
+	})
+	if received := e.(*MessageReceivedEvent); received.MessageID != bob.GetInbox()[0].ID {
+		t.Fatal("event doesn't identify the message in the inbox")
+	}
+	status, err := alice.GetMessageStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != MessageDelivered {
+		t.Fatalf("got message status %s, want %s", status, MessageDelivered)
+	}
+	if !bytes.Equal(alice.contactNicknames["bob"].spoolWriterChan.SpoolID, bob.contactNicknames["alice"].spoolReaderChan.SpoolID) {
+		t.Fatal("alice doesn't write to the spool bob reads")
+	}
+}
+
+func TestContactInfos(t *testing.T) {
+	spools := newFakeSpoolService()
+	alice := newTestClient(t, "alice", spools)
+	bob := newTestClient(t, "bob", spools)
+	pairTestClients(t, alice, bob)
+	sendTestMessage(t, alice, "bob", "hello bob")
+	settle(alice)
+	exchangeMessages(bob, alice)
+	sendTestMessage(t, bob, "alice", "hello alice")
+	settle(bob)
+	poll(alice)
+
+	for _, nickname := range []string{"carol", "dave"} {
+		spoolReaderChan, err := alice.newContactSpool()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := alice.createManualContact(nickname, spoolReaderChan); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Dave's key exchange went through PANDA and failed after its first stage.
+	dave := alice.contactNicknames["dave"]
+	pandaKeyExchange, err := proto.Marshal(&panda_proto.KeyExchange{
+		Status:           panda_proto.KeyExchange_EXCHANGE1.Enum(),
+		KeyExchangeBytes: dave.keyExchange,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dave.pandaKeyExchange = pandaKeyExchange
+	dave.keyExchange = nil
+	dave.pandaResult = "meeting place unreachable"
+
+	want := map[string]ContactInfo{
+		"bob":   {Nickname: "bob", MessagesReceived: 1, MessagesSent: 1},
+		"carol": {Nickname: "carol", IsPending: true, ManualExchange: true},
+		"dave":  {Nickname: "dave", IsPending: true, PandaStage: "EXCHANGE1", PandaResult: "meeting place unreachable"},
+	}
+	infos := alice.contactInfos()
+	if len(infos) != len(want) {
+		t.Fatalf("got %d contacts, want %d", len(infos), len(want))
+	}
+	for _, info := range infos {
+		w, ok := want[info.Nickname]
+		if !ok {
+			t.Fatalf("unexpected contact %s", info.Nickname)
+		}
+		info.AddedTime = time.Time{}
+		if *info != w {
+			t.Fatalf("got %+v, want %+v", *info, w)
+		}
+	}
+}
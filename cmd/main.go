@@ -17,6 +17,9 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/katzenpost/catshadow"
@@ -40,15 +43,42 @@ func randUser() string {
 	return fmt.Sprintf("%x", user[:])
 }
 
+// readNewPassphrase prompts for a new statefile
+// passphrase twice and returns it if both match.
+func readNewPassphrase() ([]byte, error) {
+	fmt.Print("Enter new statefile passphrase: ")
+	passphrase, err := terminal.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		return nil, err
+	}
+	fmt.Print("\nConfirm new statefile passphrase: ")
+	confirmation, err := terminal.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		return nil, err
+	}
+	fmt.Print("\n")
+	if !bytes.Equal(passphrase, confirmation) {
+		return nil, errors.New("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
 func main() {
 	const defaultMsgNum = 1
 	const defaultMsgInterval = 2000
 	const defaultBlockSize = 1
+	const sendTimeout = 5 * time.Minute
 
 	generate := flag.Bool("g", false, "Generate the state file and then run client.")
 	cfgFile := flag.String("f", "katzenpost.toml", "Path to the client config file.")
 	stateFile := flag.String("s", "catshadow_statefile", "The catshadow state file path.")
 	spawnShell := flag.Bool("shell", false, "Spawns a shell to interact with the catshadow client")
+	rekey := flag.Bool("rekey", false, "Change the statefile passphrase and then exit.")
+	drainLimit := flag.Int("drain", 10, "Maximum number of messages read from the remote spool per poll")
+	recoverSpools := flag.Bool("recover", true, "Automatically replace remote spools lost by the Provider")
+	retention := flag.Duration("retention", 0, "How long messages are kept, zero keeps them forever")
+	downloadDir := flag.String("downloads", "downloads", "Directory received files are written to")
+	quarantineTimeout := flag.Duration("quarantine", 7*24*time.Hour, "How long undecryptable messages are kept for a later attempt")
 	message := flag.String("m", "", "Text you want to send as message")
 	nickName := flag.String("n", "", "Nickname of recipient you want to send a message to")
 	messageNum := flag.Int("num", defaultMsgNum, "Total number of messages you want to send")
@@ -95,6 +125,24 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if *rekey {
+		stateWorker, _, err = catshadow.LoadStateWriter(c.GetLogger("catshadow_state"), *stateFile, passphrase)
+		if err != nil {
+			panic(err)
+		}
+		newPassphrase, err := readNewPassphrase()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read new passphrase: %v\n", err)
+			os.Exit(-1)
+		}
+		err = stateWorker.Rekey(passphrase, newPassphrase)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to change statefile passphrase: %v\n", err)
+			os.Exit(-1)
+		}
+		fmt.Println("statefile passphrase changed")
+		return
+	}
 	if *generate {
 		if _, err := os.Stat(*stateFile); !os.IsNotExist(err) {
 			panic("cannot generate state file, already exists")
@@ -113,8 +161,8 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
-		fmt.Println("creating remote message receiver spool")
-		catShadowClient, err = catshadow.NewClientAndRemoteSpool(c.GetBackendLog(), c, stateWorker, user, linkKey)
+		fmt.Println("creating catshadow client")
+		catShadowClient, err = catshadow.NewClientAndState(c.GetBackendLog(), c, stateWorker, user, linkKey)
 		if err != nil {
 			panic(err)
 		}
@@ -131,6 +179,11 @@ func main() {
 	}
 	stateWorker.Start()
 	fmt.Println("state worker started")
+	catShadowClient.SetSpoolDrainLimit(*drainLimit)
+	catShadowClient.SetQuarantineTimeout(*quarantineTimeout)
+	catShadowClient.SetSpoolRecovery(*recoverSpools)
+	catShadowClient.SetDownloadDir(*downloadDir)
+	catShadowClient.SetRetention(*retention)
 	catShadowClient.Start()
 	fmt.Println("catshadow worker started")
 	if *message != "" && *nickName != "" {
@@ -144,8 +197,18 @@ func main() {
 				}
 			}
 		}
-		catShadowClient.Shutdown() // ensures that client shuts down properly - waits for pending messages to be sent
+		// Wait for the queued messages to be written to the spool,
+		// those which are not are sent the next time the client runs.
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		err := catShadowClient.Drain(ctx)
+		cancel()
+		catShadowClient.Shutdown()
+		if err != nil {
+			fmt.Printf("Not all messages were sent, they remain queued: %v\n", err)
+			return
+		}
 		fmt.Println("Finished sending all messages.")
+		return
 	}
 	if *spawnShell {
 		fmt.Println("starting shell")
@@ -17,8 +17,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/katzenpost/catshadow"
@@ -52,15 +57,22 @@ func NewShell(client *catshadow.Client, log *logging.Logger) *Shell {
 
 	shell.ishell.AddCmd(&ishell.Cmd{
 		Name: "list_inbox",
-		Help: "List inbox.",
+		Help: "List inbox, optionally only the messages from the given contact.",
 		Func: func(c *ishell.Context) {
 			// disable the '>>>' for cleaner same line input.
 			c.ShowPrompt(false)
 			defer c.ShowPrompt(true) // yes, revert after login.
 			inbox := shell.client.GetInbox()
-			c.Print(fmt.Sprintf("ID\tNickname\n"))
-			for id, message := range inbox {
-				c.Print(fmt.Sprintf("%d\t%s\n", id, message.Nickname))
+			if len(c.Args) > 0 {
+				inbox = shell.client.GetContactInbox(c.Args[0])
+			}
+			c.Print(fmt.Sprintf("  ID\t\t\tReceived\t\tNickname\n"))
+			for _, message := range inbox {
+				unread := " "
+				if !message.Read {
+					unread = green("*")
+				}
+				c.Print(fmt.Sprintf("%s %s\t%s\t%s\n", unread, message.ID, message.ReceivedTime.Format(time.Stamp), message.Nickname))
 			}
 			c.Print("\n")
 		},
@@ -68,25 +80,65 @@ func NewShell(client *catshadow.Client, log *logging.Logger) *Shell {
 
 	shell.ishell.AddCmd(&ishell.Cmd{
 		Name: "read_inbox",
-		Help: "Read inbox.",
+		Help: "Read a message from the inbox.",
 		Func: func(c *ishell.Context) {
 			// disable the '>>>' for cleaner same line input.
 			c.ShowPrompt(false)
 			defer c.ShowPrompt(true) // yes, revert after login.
 			c.Print(red("message ID: "))
 			rawid := c.ReadLine()
-			id, err := strconv.Atoi(rawid)
-			if err != nil || id < 0 {
-				c.Print(fmt.Sprintf("ERROR, invalid message id, must be positive integer\n"))
-			} else {
-				inbox := shell.client.GetInbox()
-				if id > len(inbox) {
-					c.Print(fmt.Sprintf("ERROR, requested message id doesn't exist\n"))
-				} else {
-					mesg := inbox[id]
-					c.Print(fmt.Sprintf("%s %s\n%s", mesg.Nickname, mesg.ReceivedTime, mesg.Plaintext))
-					c.Print("\n")
-				}
+			id, err := strconv.ParseUint(rawid, 16, 64)
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, invalid message id\n"))
+				return
+			}
+			mesg, err := shell.client.ReadMessage(catshadow.MessageID(id))
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
+				return
+			}
+			c.Print(fmt.Sprintf("From: %s\nReceived: %s\n", mesg.Nickname, mesg.ReceivedTime.Format(time.Stamp)))
+			if !mesg.SentTime.IsZero() {
+				c.Print(fmt.Sprintf("Sent: %s\n", mesg.SentTime.Format(time.Stamp)))
+			}
+			c.Print(fmt.Sprintf("\n%s\n", mesg.Plaintext))
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "mark_unread",
+		Help: "Mark a message in the inbox as unread.",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			c.Print(red("message ID: "))
+			id, err := strconv.ParseUint(c.ReadLine(), 16, 64)
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, invalid message id\n"))
+				return
+			}
+			err = shell.client.MarkRead(catshadow.MessageID(id), false)
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
+			}
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "delete_message",
+		Help: "Delete a message from the inbox.",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			c.Print(red("message ID: "))
+			id, err := strconv.ParseUint(c.ReadLine(), 16, 64)
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, invalid message id\n"))
+				return
+			}
+			err = shell.client.DeleteMessage(context.Background(), catshadow.MessageID(id))
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
 			}
 		},
 	})
@@ -100,7 +152,10 @@ func NewShell(client *catshadow.Client, log *logging.Logger) *Shell {
 			c.Print(red("Contact nickname: "))
 			nickname := c.ReadLine()
 
-			shell.client.RemoveContact(nickname)
+			err := shell.client.DeleteContact(context.Background(), nickname)
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
+			}
 		},
 	})
 	shell.ishell.AddCmd(&ishell.Cmd{
@@ -115,7 +170,167 @@ func NewShell(client *catshadow.Client, log *logging.Logger) *Shell {
 
 			c.Print("Enter a shared PANDA passphrase: ")
 			passphrase := c.ReadPassword()
-			shell.client.NewContact(nickname, []byte(passphrase))
+			err := shell.client.AddContact(context.Background(), nickname, []byte(passphrase))
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
+			}
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "restart_key_exchange",
+		Help: "Restart a failed key exchange with a contact",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			c.Print(red("Contact nickname: "))
+			nickname := c.ReadLine()
+
+			c.Print("Enter a new shared PANDA passphrase or leave empty to reuse the previous one: ")
+			passphrase := c.ReadPassword()
+			err := shell.client.RestartKeyExchange(context.Background(), nickname, []byte(passphrase))
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
+			}
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "add_contact_manual",
+		Help: "Add a new contact with an out-of-band key exchange instead of PANDA",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			c.Print(red("Contact nickname: "))
+			nickname := c.ReadLine()
+			err := shell.client.AddManualContact(context.Background(), nickname)
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
+				return
+			}
+			shell.exportContact(c, nickname)
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "export_contact",
+		Help: "Export our exchange for a contact added with add_contact_manual",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			c.Print(red("Contact nickname: "))
+			nickname := c.ReadLine()
+			shell.exportContact(c, nickname)
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "import_contact",
+		Help: "Import a contact's exchange to complete an out-of-band key exchange",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			c.Print(red("Contact nickname: "))
+			nickname := c.ReadLine()
+			c.Print("Paste the contact's exchange or enter the path of its file: ")
+			armored := c.ReadLine()
+			if strings.HasPrefix(armored, "-----BEGIN") {
+				armored += "\n" + c.ReadMultiLinesFunc(func(line string) bool {
+					return !strings.HasPrefix(strings.TrimSpace(line), "-----END")
+				})
+			} else {
+				data, err := ioutil.ReadFile(armored)
+				if err != nil {
+					c.Print(fmt.Sprintf("ERROR, %s\n", err))
+					return
+				}
+				armored = string(data)
+			}
+			err := shell.client.ImportContactExchange(context.Background(), nickname, armored)
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
+				return
+			}
+			c.Println("Key exchange completed.")
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "safety_number",
+		Help: "Show the safety number to compare with a contact",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			c.Print(red("Contact nickname: "))
+			nickname := c.ReadLine()
+			number, err := shell.client.SafetyNumber(context.Background(), nickname)
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
+				return
+			}
+			c.Print(fmt.Sprintf("Safety number: %s\n", number))
+			c.Println("The contact sees the same safety number, compare it over a channel you trust.")
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "verify_contact",
+		Help: "Compare the safety number read by a contact and mark it as verified",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			c.Print(red("Contact nickname: "))
+			nickname := c.ReadLine()
+			c.Print("Contact's safety number: ")
+			number := c.ReadLine()
+			if strings.TrimSpace(number) == "" {
+				c.Print(fmt.Sprintf("ERROR, safety number is required\n"))
+				return
+			}
+			err := shell.client.VerifyContact(context.Background(), nickname, number)
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", red(err.Error())))
+				return
+			}
+			c.Println(green("Safety numbers match, contact verified."))
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "mark_verified",
+		Help: "Mark a contact as verified or not verified",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			c.Print(red("Contact nickname: "))
+			nickname := c.ReadLine()
+			c.Print("Verified (yes/no): ")
+			answer := strings.ToLower(strings.TrimSpace(c.ReadLine()))
+			if answer != "yes" && answer != "no" {
+				c.Print(fmt.Sprintf("ERROR, answer yes or no\n"))
+				return
+			}
+			err := shell.client.SetContactVerified(context.Background(), nickname, answer == "yes")
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
+			}
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "rotate_spool",
+		Help: "Move a contact to a new remote spool",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			c.Print(red("Contact nickname: "))
+			nickname := c.ReadLine()
+			err := shell.client.RotateSpool(context.Background(), nickname)
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
+				return
+			}
+			c.Println("Spool rotated, the old spool is purged once the contact has switched.")
 		},
 	})
 	shell.ishell.AddCmd(&ishell.Cmd{
@@ -133,6 +348,49 @@ func NewShell(client *catshadow.Client, log *logging.Logger) *Shell {
 			c.Print("\n")
 		},
 	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "contact_status",
+		Help: "Show the key exchange status of each contact.",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			contacts := shell.client.GetContacts()
+			sort.Slice(contacts, func(i, j int) bool {
+				return contacts[i].Nickname < contacts[j].Nickname
+			})
+			for _, contact := range contacts {
+				status := green("established")
+				if contact.IsPending {
+					status = fmt.Sprintf("pending (PANDA stage %s)", contact.PandaStage)
+					if contact.ManualExchange {
+						status = "pending (waiting for the contact's exchange to be imported)"
+					} else if contact.PandaStage == "" {
+						status = red("pending (no key exchange running)")
+					}
+				}
+				if !contact.IsPending && contact.PandaResult == "" {
+					if contact.Verified {
+						status += ", " + green("verified")
+					} else {
+						status += ", not verified"
+					}
+				}
+				c.Print(fmt.Sprintf("%s: %s\n", contact.Nickname, status))
+				if contact.PandaResult != "" {
+					c.Print(fmt.Sprintf("\tkey exchange failure: %s\n", red(contact.PandaResult)))
+				}
+				if contact.SpoolLost {
+					c.Print(fmt.Sprintf("\t%s\n", red("spool lost, waiting for a new spool")))
+				}
+				if !contact.AddedTime.IsZero() {
+					c.Print(fmt.Sprintf("\tadded: %s\n", contact.AddedTime.Format(time.Stamp)))
+				}
+				c.Print(fmt.Sprintf("\tmessages received: %d, sent: %d\n", contact.MessagesReceived, contact.MessagesSent))
+			}
+			c.Print("\n")
+		},
+	})
 	shell.ishell.AddCmd(&ishell.Cmd{
 		Name: "send_message",
 		Help: "Send a message.",
@@ -145,7 +403,230 @@ func NewShell(client *catshadow.Client, log *logging.Logger) *Shell {
 
 			c.Print("Message: (ctrl-D to end)\n")
 			message := c.ReadMultiLines("\n.\n")
-			shell.client.SendMessage(nickname, []byte(message))
+			id, err := shell.client.Send(context.Background(), nickname, []byte(message))
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
+				return
+			}
+			c.Print(fmt.Sprintf("Message ID: %s\n", id))
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "list_sent",
+		Help: "List sent messages and their delivery status.",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			sent := shell.client.GetSentMessages()
+			c.Print(fmt.Sprintf("ID\t\t\tNickname\tStatus\tSent\n"))
+			for _, message := range sent {
+				c.Print(fmt.Sprintf("%s\t%s\t%s\t%s\n", message.ID, message.Nickname, message.Status, message.SentTime.Format(time.Stamp)))
+			}
+			c.Print("\n")
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "conversation",
+		Help: "Show the messages exchanged with a contact.",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			nickname := ""
+			if len(c.Args) > 0 {
+				nickname = c.Args[0]
+			} else {
+				c.Print(red("Contact nickname: "))
+				nickname = c.ReadLine()
+			}
+			for _, message := range shell.client.Conversation(nickname) {
+				if message.Outgoing {
+					c.Print(fmt.Sprintf("%s >>> me (%s)\n", message.Time.Format(time.Stamp), message.Status))
+				} else {
+					c.Print(fmt.Sprintf("%s <<< %s\n", message.Time.Format(time.Stamp), green(nickname)))
+				}
+				c.Print(fmt.Sprintf("%s\n\n", message.Plaintext))
+			}
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "set_retention",
+		Help: "Set how long the messages exchanged with a contact are kept.",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			c.Print(red("Contact nickname: "))
+			nickname := c.ReadLine()
+			c.Print("Retention period, e.g. 24h, or 0 for the default: ")
+			retention, err := time.ParseDuration(c.ReadLine())
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
+				return
+			}
+			c.Print("Apply to the contact's messages too? [y/N]: ")
+			notify := c.ReadLine() == "y"
+			err = shell.client.SetContactRetention(context.Background(), nickname, retention, notify)
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
+			}
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "send_file",
+		Help: "Offer a file to a contact.",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			c.Print(red("Contact nickname: "))
+			nickname := c.ReadLine()
+			c.Print("File path: ")
+			path := c.ReadLine()
+			id, err := shell.client.SendFile(context.Background(), nickname, path)
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
+				return
+			}
+			c.Print(fmt.Sprintf("Transfer ID: %s\n", id))
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "accept_file",
+		Help: "Accept a file offered by a contact.",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			c.Print(red("Transfer ID: "))
+			rawid := c.ReadLine()
+			id, err := strconv.ParseUint(rawid, 16, 64)
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, invalid transfer id\n"))
+				return
+			}
+			err = shell.client.AcceptFile(context.Background(), catshadow.MessageID(id))
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
+			}
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "list_transfers",
+		Help: "List file transfers and their progress.",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			transfers := shell.client.GetTransfers()
+			sort.Slice(transfers, func(i, j int) bool {
+				return transfers[i].StartTime.Before(transfers[j].StartTime)
+			})
+			c.Print(fmt.Sprintf("ID			Direction	Nickname	Status	Progress	File\n"))
+			for _, t := range transfers {
+				direction := "from"
+				if t.Outgoing {
+					direction = "to"
+				}
+				c.Print(fmt.Sprintf("%s\t%s\t\t%s\t%s\t%d/%d\t\t%s (%d bytes)\n", t.ID, direction, t.Nickname, t.Status, t.ChunksDone, t.ChunkCount, t.Name, t.Size))
+				if t.Path != "" {
+					c.Print(fmt.Sprintf("\tsaved to %s\n", t.Path))
+				}
+				if t.Err != "" {
+					c.Print(fmt.Sprintf("\t%s\n", red(t.Err)))
+				}
+			}
+			c.Print("\n")
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "introduce",
+		Help: "Introduce two contacts to each other.",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			c.Print(red("First contact nickname: "))
+			nickname1 := c.ReadLine()
+			c.Print(red("Second contact nickname: "))
+			nickname2 := c.ReadLine()
+			err := shell.client.Introduce(context.Background(), nickname1, nickname2)
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
+				return
+			}
+			c.Println("Introduction sent, the contacts are introduced once both accept it.")
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "list_introductions",
+		Help: "List introductions made by contacts.",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			intros := shell.client.GetIntroductions()
+			sort.Slice(intros, func(i, j int) bool {
+				return intros[i].ReceivedTime.Before(intros[j].ReceivedTime)
+			})
+			c.Print(fmt.Sprintf("ID			Introducer	Nickname	Status\n"))
+			for _, intro := range intros {
+				status := "new"
+				if intro.Accepted {
+					status = "accepted"
+				}
+				c.Print(fmt.Sprintf("%s\t%s\t\t%s\t\t%s\n", intro.ID, intro.Introducer, intro.Nickname, status))
+			}
+			c.Print("\n")
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "accept_introduction",
+		Help: "Accept an introduction and add the introduced contact.",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			c.Print(red("Introduction ID: "))
+			rawid := c.ReadLine()
+			id, err := strconv.ParseUint(rawid, 16, 64)
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, invalid introduction id\n"))
+				return
+			}
+			c.Print("Nickname (empty for the introducer's): ")
+			nickname := c.ReadLine()
+			err = shell.client.AcceptIntroduction(context.Background(), catshadow.MessageID(id), nickname)
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
+				return
+			}
+			c.Println("Introduction accepted, the key exchange completes once the other contact accepts it.")
+		},
+	})
+	shell.ishell.AddCmd(&ishell.Cmd{
+		Name: "change_passphrase",
+		Help: "Change the statefile passphrase.",
+		Func: func(c *ishell.Context) {
+			// disable the '>>>' for cleaner same line input.
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true) // yes, revert after login.
+			c.Print("Current statefile passphrase: ")
+			oldPassphrase := c.ReadPassword()
+			c.Print("New statefile passphrase: ")
+			newPassphrase := c.ReadPassword()
+			c.Print("Confirm new statefile passphrase: ")
+			if c.ReadPassword() != newPassphrase {
+				c.Print(fmt.Sprintf("ERROR, passphrases do not match\n"))
+				return
+			}
+			err := shell.client.ChangePassphrase([]byte(oldPassphrase), []byte(newPassphrase))
+			if err != nil {
+				c.Print(fmt.Sprintf("ERROR, %s\n", err))
+				return
+			}
+			c.Print(green("Statefile passphrase changed.\n"))
 		},
 	})
 	shell.ishell.AddCmd(&ishell.Cmd{
@@ -169,6 +650,25 @@ func NewShell(client *catshadow.Client, log *logging.Logger) *Shell {
 	return shell
 }
 
+// exportContact prints our exchange for the contact or writes
+// it to a file, for the contact to import.
+func (s *Shell) exportContact(c *ishell.Context, nickname string) {
+	armored, err := s.client.ExportContactExchange(context.Background(), nickname)
+	if err != nil {
+		c.Print(fmt.Sprintf("ERROR, %s\n", err))
+		return
+	}
+	c.Print("File path (empty to print the exchange): ")
+	path := c.ReadLine()
+	if path == "" {
+		c.Print(armored)
+	} else if err := ioutil.WriteFile(path, []byte(armored), 0600); err != nil {
+		c.Print(fmt.Sprintf("ERROR, %s\n", err))
+		return
+	}
+	c.Println("Give the exchange to the contact and import theirs with import_contact.")
+}
+
 // Run runs the Shell.
 func (s *Shell) Run() {
 	// Let ishell do signal handling.
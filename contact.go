@@ -17,18 +17,31 @@
 package catshadow
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"time"
+
+	"github.com/golang/protobuf/proto"
 	"github.com/katzenpost/channels"
 	"github.com/katzenpost/client/session"
 	"github.com/katzenpost/core/crypto/rand"
 	ratchet "github.com/katzenpost/doubleratchet"
+	panda_proto "github.com/katzenpost/panda/crypto/proto"
 	"github.com/ugorji/go/codec"
 )
 
 var cborHandle = new(codec.CborHandle)
 
+// maxDecryptedHashes is the number of recently decrypted
+// ciphertexts remembered for each contact.
+const maxDecryptedHashes = 64
+
 type contactExchange struct {
 	SpoolWriter       *channels.UnreliableSpoolWriterChannel
 	SignedKeyExchange *ratchet.SignedKeyExchange
+	// Version is the highest protocol version supported by the
+	// sender, it is zero for senders which predate envelopes.
+	Version uint8
 }
 
 // NewContactExchangeBytes returns serialized contact exchange information.
@@ -36,6 +49,7 @@ func NewContactExchangeBytes(spoolWriter *channels.UnreliableSpoolWriterChannel,
 	exchange := contactExchange{
 		SpoolWriter:       spoolWriter,
 		SignedKeyExchange: signedKeyExchange,
+		Version:           envelopeVersion,
 	}
 	var serialized []byte
 	err := codec.NewEncoderBytes(&serialized, cborHandle).Encode(exchange)
@@ -61,8 +75,22 @@ type serializedContact struct {
 	KeyExchange      []byte
 	PandaKeyExchange []byte
 	PandaResult      string
+	SharedSecret     []byte
 	Ratchet          []byte
+	SpoolReaderChan  *channels.UnreliableSpoolReaderChannel
 	SpoolWriterChan  *channels.UnreliableSpoolWriterChannel
+	AddedTime        time.Time
+
+	OldSpoolReaderChans []*channels.UnreliableSpoolReaderChannel
+	LeavingSharedSpool  bool
+	RotationID          MessageID
+	RotationAckTime     time.Time
+
+	PeerVersion uint8
+	Retention   time.Duration
+	Verified    bool
+
+	Decrypted [][]byte
 }
 
 // Contact is a communications contact that we have bidirectional
@@ -83,38 +111,181 @@ type Contact struct {
 	pandaShutdownChan chan struct{}
 	// pandaResult contains an error message if the PANDA exchange fails.
 	pandaResult string
+	// sharedSecret is the PANDA shared secret, it is kept until the
+	// key exchange completes so that a failed exchange can be restarted.
+	sharedSecret []byte
 
 	// ratchet is the client's double ratchet for end to end encryption
 	ratchet *ratchet.Ratchet
 
+	// spoolReaderChan is the remote spool dedicated to messages from
+	// this contact. It is nil for contacts created before per contact
+	// spools, who write to the Client's shared spool instead.
+	spoolReaderChan *channels.UnreliableSpoolReaderChannel
+
+	// oldSpoolReaderChans are the spools the contact wrote to before
+	// the last spool rotation. They are read until they have been
+	// drained after the contact switched to the current spool.
+	oldSpoolReaderChans []*channels.UnreliableSpoolReaderChannel
+
+	// leavingSharedSpool is true if the contact wrote to the shared
+	// spool before the last spool rotation.
+	leavingSharedSpool bool
+
+	// rotationID is the ID of the control message which told the
+	// contact to write to the current spool after the last rotation.
+	rotationID MessageID
+
+	// rotationAckTime is the time the contact acknowledged the
+	// control message with the rotationID, it is zero if the contact
+	// may not yet have switched to the current spool.
+	rotationAckTime time.Time
+
+	// peerVersion is the highest protocol version the contact
+	// is known to support, it determines the wire format of the
+	// messages sent to the contact.
+	peerVersion uint8
+
+	// retention is the retention period of the messages exchanged
+	// with the contact, zero means the Client's default applies.
+	retention time.Duration
+
+	// verified is true once the contact's safety number
+	// has been confirmed out of band.
+	verified bool
+
+	// spoolLost is true if the spool the contact writes to no longer
+	// exists on the Provider and has not yet been replaced.
+	spoolLost bool
+
+	// decrypted holds the hashes of the ciphertexts most recently
+	// decrypted with the contact's ratchet. A spool write whose reply
+	// was lost is retried and the contact's spool then holds the same
+	// ciphertext twice, the copy is recognized and dropped.
+	decrypted [][]byte
+
 	// spoolWriterChan is a spool channel we must write to in order to
 	// send this contact a message.
 	spoolWriterChan *channels.UnreliableSpoolWriterChannel
+
+	// addedTime is the time the contact was added.
+	addedTime time.Time
 }
 
-// NewContact creates a new Contact or returns an error.
+// ContactInfo is a snapshot of a Contact's status.
+type ContactInfo struct {
+	// Nickname is the contact's nickname.
+	Nickname string
+	// IsPending is true if the key exchange has not been completed.
+	IsPending bool
+	// PandaStage is the last PANDA stage reached by a pending key
+	// exchange: INIT, EXCHANGE1 or EXCHANGE2.
+	PandaStage string
+	// PandaResult contains an error message if the key exchange failed.
+	PandaResult string
+	// ManualExchange is true if the key exchange is waiting for the
+	// contact's exchange to be imported with ImportContactExchange.
+	ManualExchange bool
+	// AddedTime is the time the contact was added.
+	AddedTime time.Time
+	// MessagesReceived is the number of messages from the contact in the inbox.
+	MessagesReceived int
+	// MessagesSent is the number of messages we sent to the contact.
+	MessagesSent int
+	// SpoolLost is true if the spool the contact writes to was lost
+	// and has not yet been replaced.
+	SpoolLost bool
+	// Retention is the contact's message retention
+	// period, zero if the default applies.
+	Retention time.Duration
+	// Verified is true once the contact's safety
+	// number has been confirmed out of band.
+	Verified bool
+}
+
+// NewContact creates a new Contact or returns an error. The given
+// spoolReaderChan is the remote spool dedicated to the contact's
+// messages, its spool writer is sent to the contact in the key
+// exchange.
 func NewContact(nickname string, id uint64, spoolReaderChan *channels.UnreliableSpoolReaderChannel, session *session.Session) (*Contact, error) {
-	ratchet, err := ratchet.New(rand.Reader)
+	contact := &Contact{
+		nickname:        nickname,
+		id:              id,
+		spoolReaderChan: spoolReaderChan,
+		addedTime:       time.Now(),
+	}
+	err := contact.resetKeyExchange(spoolReaderChan)
 	if err != nil {
 		return nil, err
 	}
-	signedKeyExchange, err := ratchet.CreateKeyExchange()
+	return contact, nil
+}
+
+// resetKeyExchange replaces the contact's double ratchet with a new
+// one and generates the key exchange to be sent to the contact.
+func (c *Contact) resetKeyExchange(spoolReaderChan *channels.UnreliableSpoolReaderChannel) error {
+	r, err := ratchet.New(rand.Reader)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	signedKeyExchange, err := r.CreateKeyExchange()
+	if err != nil {
+		return err
 	}
 	spoolWriterChan := spoolReaderChan.GetSpoolWriter()
 	exchange, err := NewContactExchangeBytes(spoolWriterChan, signedKeyExchange)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	c.isPending = true
+	c.ratchet = r
+	c.keyExchange = exchange
+	c.pandaKeyExchange = nil
+	c.pandaResult = ""
+	c.verified = false
+	c.decrypted = nil
+	c.pandaShutdownChan = make(chan struct{})
+	c.spoolWriterChan = nil
+	return nil
+}
+
+// isDuplicate returns true if the ciphertext
+// was already decrypted with the contact's ratchet.
+func (c *Contact) isDuplicate(ciphertext []byte) bool {
+	hash := sha256.Sum256(ciphertext)
+	for _, h := range c.decrypted {
+		if bytes.Equal(h, hash[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// addDecrypted remembers the hash of a ciphertext decrypted
+// with the contact's ratchet, forgetting the oldest one.
+func (c *Contact) addDecrypted(ciphertext []byte) {
+	hash := sha256.Sum256(ciphertext)
+	if len(c.decrypted) >= maxDecryptedHashes {
+		c.decrypted = c.decrypted[1:]
+	}
+	c.decrypted = append(c.decrypted, hash[:])
+}
+
+// readsSharedSpool returns true if the
+// contact writes or wrote to the shared spool.
+func (c *Contact) readsSharedSpool() bool {
+	return c.spoolReaderChan == nil || c.leavingSharedSpool
+}
+
+// setPeerVersion records the protocol version
+// the contact has told us it supports.
+func (c *Contact) setPeerVersion(version uint8) {
+	if version > envelopeVersion {
+		version = envelopeVersion
+	}
+	if version > c.peerVersion {
+		c.peerVersion = version
 	}
-	return &Contact{
-		nickname:          nickname,
-		id:                id,
-		isPending:         true,
-		ratchet:           ratchet,
-		keyExchange:       exchange,
-		pandaShutdownChan: make(chan struct{}),
-	}, nil
 }
 
 // ID returns the Contact ID.
@@ -122,6 +293,19 @@ func (c *Contact) ID() uint64 {
 	return c.id
 }
 
+// pandaStage returns the stage of the contact's PANDA key
+// exchange or an empty string if there is none in progress.
+func (c *Contact) pandaStage() string {
+	if c.pandaKeyExchange == nil {
+		return ""
+	}
+	kx := new(panda_proto.KeyExchange)
+	if err := proto.Unmarshal(c.pandaKeyExchange, kx); err != nil {
+		return ""
+	}
+	return kx.GetStatus().String()
+}
+
 // MarshalBinary does what you expect and returns
 // a serialized Contact.
 func (c *Contact) MarshalBinary() ([]byte, error) {
@@ -136,8 +320,22 @@ func (c *Contact) MarshalBinary() ([]byte, error) {
 		KeyExchange:      c.keyExchange,
 		PandaKeyExchange: c.pandaKeyExchange,
 		PandaResult:      c.pandaResult,
+		SharedSecret:     c.sharedSecret,
 		Ratchet:          ratchetBlob,
+		SpoolReaderChan:  c.spoolReaderChan,
 		SpoolWriterChan:  c.spoolWriterChan,
+		AddedTime:        c.addedTime,
+
+		OldSpoolReaderChans: c.oldSpoolReaderChans,
+		LeavingSharedSpool:  c.leavingSharedSpool,
+		RotationID:          c.rotationID,
+		RotationAckTime:     c.rotationAckTime,
+
+		PeerVersion: c.peerVersion,
+		Retention:   c.retention,
+		Verified:    c.verified,
+
+		Decrypted: c.decrypted,
 	}
 	var serialized []byte
 	err = codec.NewEncoderBytes(&serialized, cborHandle).Encode(s)
@@ -173,8 +371,19 @@ func (c *Contact) UnmarshalBinary(data []byte) error {
 	c.keyExchange = s.KeyExchange
 	c.pandaKeyExchange = s.PandaKeyExchange
 	c.pandaResult = s.PandaResult
+	c.sharedSecret = s.SharedSecret
 	c.ratchet = r
+	c.spoolReaderChan = s.SpoolReaderChan
 	c.spoolWriterChan = s.SpoolWriterChan
+	c.addedTime = s.AddedTime
+	c.oldSpoolReaderChans = s.OldSpoolReaderChans
+	c.leavingSharedSpool = s.LeavingSharedSpool
+	c.rotationID = s.RotationID
+	c.rotationAckTime = s.RotationAckTime
+	c.peerVersion = s.PeerVersion
+	c.retention = s.Retention
+	c.verified = s.Verified
+	c.decrypted = s.Decrypted
 
 	return nil
 }
@@ -0,0 +1,69 @@
+// conversation.go - per contact conversation history
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"sort"
+	"time"
+)
+
+// ConversationMessage is a message sent to or received from a contact.
+type ConversationMessage struct {
+	// ID is the inbox ID of a received message or the
+	// ID returned by SendMessage for a sent message.
+	ID MessageID
+	// Outgoing is true if we sent the message.
+	Outgoing bool
+	// Plaintext is the message.
+	Plaintext []byte
+	// Time is the time the message was sent or received.
+	Time time.Time
+	// Status is the delivery status of a sent message.
+	Status MessageStatus
+	// Read is true if a received message has been read.
+	Read bool
+}
+
+// Conversation returns the messages sent to and received from the
+// contact with the given nickname in chronological order.
+func (c *Client) Conversation(nickname string) []*ConversationMessage {
+	conversation := []*ConversationMessage{}
+	for _, m := range c.GetContactInbox(nickname) {
+		conversation = append(conversation, &ConversationMessage{
+			ID:        m.ID,
+			Plaintext: m.Plaintext,
+			Time:      m.ReceivedTime,
+			Read:      m.Read,
+		})
+	}
+	for _, m := range c.GetSentMessages() {
+		if m.Nickname != nickname {
+			continue
+		}
+		conversation = append(conversation, &ConversationMessage{
+			ID:        m.ID,
+			Outgoing:  true,
+			Plaintext: m.Plaintext,
+			Time:      m.SentTime,
+			Status:    m.Status,
+		})
+	}
+	sort.SliceStable(conversation, func(i, j int) bool {
+		return conversation[i].Time.Before(conversation[j].Time)
+	})
+	return conversation
+}
@@ -0,0 +1,65 @@
+// conversation_test.go - conversation history tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"testing"
+)
+
+func TestConversation(t *testing.T) {
+	spools := newFakeSpoolService()
+	alice := newTestClient(t, "alice", spools)
+	bob := newTestClient(t, "bob", spools)
+	carol := newTestClient(t, "carol", spools)
+	pairTestClients(t, alice, bob)
+	pairTestClients(t, alice, carol)
+
+	sendTestMessage(t, alice, "bob", "hello bob")
+	settle(alice)
+	exchangeMessages(bob, alice)
+	sendTestMessage(t, bob, "alice", "hello alice")
+	settle(bob)
+	exchangeMessages(alice, bob)
+	sendTestMessage(t, alice, "carol", "hello carol")
+	sendTestMessage(t, alice, "bob", "how are you?")
+	settle(alice)
+
+	want := []struct {
+		outgoing bool
+		text     string
+		status   MessageStatus
+	}{
+		{true, "hello bob", MessageDelivered},
+		{false, "hello alice", MessageQueued},
+		{true, "how are you?", MessageSent},
+	}
+	conversation := alice.Conversation("bob")
+	if len(conversation) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(conversation), len(want))
+	}
+	for i, m := range conversation {
+		if m.Outgoing != want[i].outgoing || string(m.Plaintext) != want[i].text {
+			t.Fatalf("message %d is %q, outgoing %v", i, m.Plaintext, m.Outgoing)
+		}
+		if m.Outgoing && m.Status != want[i].status {
+			t.Fatalf("message %d is %s, want %s", i, m.Status, want[i].status)
+		}
+	}
+	if len(alice.Conversation("carol")) != 1 {
+		t.Fatal("conversation with carol holds messages of other contacts")
+	}
+}
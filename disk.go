@@ -17,13 +17,20 @@
 package catshadow
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/katzenpost/channels"
 	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/core/worker"
 	"github.com/ugorji/go/codec"
 	"golang.org/x/crypto/argon2"
@@ -34,14 +41,96 @@ import (
 const (
 	keySize   = 32
 	nonceSize = 24
+	saltSize  = 16
+
+	// stateFileVersion is the version of the statefile format
+	// written by the StateWriter.
+	stateFileVersion = 1
+
+	// stateFileHeaderLength is the length of the statefile header:
+	// magic, version, argon2 salt, time, memory and threads, nonce.
+	stateFileHeaderLength = 4 + 1 + saltSize + 4 + 4 + 1 + nonceSize
+
+	// These are the default argon2 parameters used to
+	// derive the statefile key from the passphrase.
+	defaultArgon2Time    = 3
+	defaultArgon2Memory  = 32 * 1024
+	defaultArgon2Threads = 4
+
+	// These bound the argon2 parameters read from a statefile
+	// header, which is not authenticated until the key has been
+	// derived with them.
+	maxArgon2Time    = 64
+	maxArgon2Memory  = 1024 * 1024
+	maxArgon2Threads = 64
 )
 
-// Message encapsulates a decrypted message and two
-// metadata fields, sender nickname and received time.
+// stateFileMagic identifies versioned statefiles, the
+// original statefile format has no header at all.
+var stateFileMagic = []byte("CSSF")
+
+// Message encapsulates a decrypted message and its metadata:
+// inbox ID, sender nickname, received and sent times and read
+// state.
 type Message struct {
+	// ID identifies the message in the inbox.
+	ID           MessageID
 	Nickname     string
 	Plaintext    []byte
 	ReceivedTime time.Time
+	// SentTime is the time the message was sent according to the
+	// sender's clock, it is zero if the sender didn't include it.
+	SentTime time.Time
+	// Read is true once the message has been read.
+	Read bool
+}
+
+// MessageID is the unique identifier of a message sent to a contact.
+type MessageID uint64
+
+// String returns the message ID as a hex string.
+func (id MessageID) String() string {
+	return fmt.Sprintf("%016x", uint64(id))
+}
+
+// MessageStatus is the delivery status of a sent message.
+type MessageStatus uint8
+
+const (
+	// MessageQueued means the message is waiting to be sent.
+	MessageQueued MessageStatus = iota
+	// MessageSent means the message was written to the contact's spool.
+	MessageSent
+	// MessageDelivered means the contact acknowledged receipt of the message.
+	MessageDelivered
+	// MessageFailed means the message could not be sent.
+	MessageFailed
+)
+
+// String returns a human readable message status.
+func (s MessageStatus) String() string {
+	switch s {
+	case MessageQueued:
+		return "queued"
+	case MessageSent:
+		return "sent"
+	case MessageDelivered:
+		return "delivered"
+	case MessageFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// SentMessage is a message sent to a contact
+// along with its delivery status.
+type SentMessage struct {
+	ID            MessageID
+	Nickname      string
+	Plaintext     []byte
+	Status        MessageStatus
+	SentTime      time.Time
+	DeliveredTime time.Time
 }
 
 // State is the struct type representing the Client's state
@@ -52,6 +141,120 @@ type State struct {
 	User            string
 	LinkKey         *ecdh.PrivateKey
 	Inbox           []*Message
+	PartialMessages []*partialMessage
+	SentMessages    []*SentMessage
+	Outbox          []*outboxEntry
+	Quarantine      []*quarantinedMessage
+	Transfers       []*fileTransfer
+
+	Introductions         []*introduction
+	ReceivedIntroductions []*receivedIntroduction
+}
+
+// kdfParams are the argon2 parameters used to derive
+// the statefile key from the passphrase.
+type kdfParams struct {
+	salt    [saltSize]byte
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+// newKDFParams returns the default argon2 parameters with a random salt.
+func newKDFParams() (*kdfParams, error) {
+	params := &kdfParams{
+		time:    defaultArgon2Time,
+		memory:  defaultArgon2Memory,
+		threads: defaultArgon2Threads,
+	}
+	_, err := io.ReadFull(rand.Reader, params.salt[:])
+	if err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// validate returns an error if the parameters
+// are out of the bounds argon2 can be run with.
+func (p *kdfParams) validate() error {
+	if p.time < 1 || p.time > maxArgon2Time {
+		return fmt.Errorf("invalid statefile argon2 time %d", p.time)
+	}
+	if p.memory > maxArgon2Memory {
+		return fmt.Errorf("invalid statefile argon2 memory %d", p.memory)
+	}
+	if p.threads < 1 || p.threads > maxArgon2Threads {
+		return fmt.Errorf("invalid statefile argon2 threads %d", p.threads)
+	}
+	return nil
+}
+
+func (p *kdfParams) deriveKey(passphrase []byte) *[keySize]byte {
+	key := new([keySize]byte)
+	copy(key[:], argon2.Key(passphrase, p.salt[:], p.time, p.memory, p.threads, keySize))
+	return key
+}
+
+// encryptStateFile returns the payload encrypted with the given
+// key under a fresh random nonce, prefixed with the statefile header.
+func encryptStateFile(payload []byte, params *kdfParams, key *[keySize]byte) ([]byte, error) {
+	nonce := [nonceSize]byte{}
+	_, err := io.ReadFull(rand.Reader, nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, stateFileHeaderLength)
+	copy(header, stateFileMagic)
+	header[4] = stateFileVersion
+	copy(header[5:], params.salt[:])
+	binary.BigEndian.PutUint32(header[5+saltSize:], params.time)
+	binary.BigEndian.PutUint32(header[9+saltSize:], params.memory)
+	header[13+saltSize] = params.threads
+	copy(header[14+saltSize:], nonce[:])
+	return secretbox.Seal(header, payload, &nonce, key), nil
+}
+
+// decryptStateFile decrypts the statefile contents with the given passphrase
+// and returns the plaintext along with the KDF parameters and key used.
+// A nil kdfParams and key are returned if the statefile has the original
+// format.
+func decryptStateFile(data, passphrase []byte) ([]byte, *kdfParams, *[keySize]byte, error) {
+	if !bytes.HasPrefix(data, stateFileMagic) {
+		// The original statefile format derived both the key and the
+		// nonce from the passphrase without a salt.
+		secret := argon2.Key(passphrase, nil, defaultArgon2Time, defaultArgon2Memory, defaultArgon2Threads, keySize+nonceSize)
+		key := [keySize]byte{}
+		nonce := [nonceSize]byte{}
+		copy(key[:], secret[0:32])
+		copy(nonce[:], secret[32:])
+		plaintext, ok := secretbox.Open(nil, data, &nonce, &key)
+		if !ok {
+			return nil, nil, nil, errors.New("failed to decrypted statefile")
+		}
+		return plaintext, nil, nil, nil
+	}
+	if len(data) < stateFileHeaderLength {
+		return nil, nil, nil, errors.New("statefile header truncated")
+	}
+	if data[4] != stateFileVersion {
+		return nil, nil, nil, fmt.Errorf("unsupported statefile version %d", data[4])
+	}
+	params := new(kdfParams)
+	copy(params.salt[:], data[5:])
+	params.time = binary.BigEndian.Uint32(data[5+saltSize:])
+	params.memory = binary.BigEndian.Uint32(data[9+saltSize:])
+	params.threads = data[13+saltSize]
+	if err := params.validate(); err != nil {
+		return nil, nil, nil, err
+	}
+	nonce := [nonceSize]byte{}
+	copy(nonce[:], data[14+saltSize:])
+	key := params.deriveKey(passphrase)
+	plaintext, ok := secretbox.Open(nil, data[stateFileHeaderLength:], &nonce, key)
+	if !ok {
+		return nil, nil, nil, errors.New("failed to decrypted statefile")
+	}
+	return plaintext, params, key, nil
 }
 
 // StateWriter takes ownership of the Client's encrypted statefile
@@ -61,90 +264,217 @@ type StateWriter struct {
 
 	log *logging.Logger
 
+	// stateCh holds at most the latest state waiting to be written,
+	// older states queued during a write are replaced by newer ones.
 	stateCh   chan []byte
 	stateFile string
 
-	key   [32]byte
-	nonce [24]byte
+	// lock serializes statefile writes and
+	// protects the key from concurrent rekeying.
+	lock      sync.Mutex
+	kdfParams *kdfParams
+	key       *[keySize]byte
 }
 
 // LoadStateWriter decrypts the given stateFile and returns the State
-// as well as a new StateWriter.
+// as well as a new StateWriter. Statefiles in the original unsalted
+// format are rewritten in the current format.
 func LoadStateWriter(log *logging.Logger, stateFile string, passphrase []byte) (*StateWriter, *State, error) {
-	secret := argon2.Key(passphrase, nil, 3, 32*1024, 4, keySize+nonceSize)
 	worker := &StateWriter{
 		log:       log,
-		stateCh:   make(chan []byte),
+		stateCh:   make(chan []byte, 1),
 		stateFile: stateFile,
 	}
-	copy(worker.key[:], secret[0:32])
-	copy(worker.nonce[:], secret[32:])
-
-	ciphertext, err := ioutil.ReadFile(stateFile)
+	ciphertext, err := readStateFile(log, stateFile)
 	if err != nil {
 		return nil, nil, err
 	}
-	plaintext, ok := secretbox.Open(nil, ciphertext, &worker.nonce, &worker.key)
-	if !ok {
-		return nil, nil, errors.New("failed to decrypted statefile")
+	plaintext, params, key, err := decryptStateFile(ciphertext, passphrase)
+	if err != nil {
+		return nil, nil, err
 	}
 	state := new(State)
 	err = codec.NewDecoderBytes(plaintext, cborHandle).Decode(state)
 	if err != nil {
 		return nil, nil, err
 	}
+	if params == nil {
+		log.Noticef("Migrating statefile to version %d.", stateFileVersion)
+		worker.kdfParams, err = newKDFParams()
+		if err != nil {
+			return nil, nil, err
+		}
+		worker.key = worker.kdfParams.deriveKey(passphrase)
+		err = worker.writeState(plaintext)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		worker.kdfParams = params
+		worker.key = key
+	}
 	return worker, state, nil
 }
 
 // NewStateWriter is a constructor for StateWriter which is to be used when creating
 // the statefile for the first time.
 func NewStateWriter(log *logging.Logger, stateFile string, passphrase []byte) (*StateWriter, error) {
-	secret := argon2.Key(passphrase, nil, 3, 32*1024, 4, keySize+nonceSize)
+	params, err := newKDFParams()
+	if err != nil {
+		return nil, err
+	}
 	worker := &StateWriter{
 		log:       log,
-		stateCh:   make(chan []byte),
+		stateCh:   make(chan []byte, 1),
 		stateFile: stateFile,
+		kdfParams: params,
+		key:       params.deriveKey(passphrase),
 	}
-	copy(worker.key[:], secret[0:32])
-	copy(worker.nonce[:], secret[32:])
 	return worker, nil
 }
 
+// queueState hands the serialized state to the worker goroutine to be
+// written to disk without waiting for the write. If a previously queued
+// state has not been written yet it is replaced, so a burst of updates
+// results in a single write.
+func (w *StateWriter) queueState(payload []byte) {
+	for {
+		select {
+		case w.stateCh <- payload:
+			return
+		default:
+		}
+		select {
+		case <-w.stateCh:
+		default:
+		}
+	}
+}
+
 // Start starts the StateWriter's worker goroutine.
 func (w *StateWriter) Start() {
 	w.log.Debug("StateWriter starting worker")
 	w.Go(w.worker)
 }
 
+// Rekey re-encrypts the statefile under a new passphrase. The old
+// passphrase must decrypt the current statefile. If the re-encrypted
+// statefile can't be written, the previous statefile and key are kept.
+func (w *StateWriter) Rekey(oldPassphrase, newPassphrase []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	ciphertext, err := readStateFile(w.log, w.stateFile)
+	if err != nil {
+		return err
+	}
+	plaintext, _, _, err := decryptStateFile(ciphertext, oldPassphrase)
+	if err != nil {
+		return errors.New("failed to decrypt statefile, wrong passphrase")
+	}
+	params, err := newKDFParams()
+	if err != nil {
+		return err
+	}
+	oldParams, oldKey := w.kdfParams, w.key
+	w.kdfParams = params
+	w.key = params.deriveKey(newPassphrase)
+	err = w.write(plaintext)
+	if err != nil {
+		w.kdfParams = oldParams
+		w.key = oldKey
+		return err
+	}
+	w.log.Notice("Statefile passphrase changed.")
+	return nil
+}
+
 func (w *StateWriter) writeState(payload []byte) error {
-	ciphertext := secretbox.Seal(nil, payload, &w.nonce, &w.key)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.write(payload)
+}
+
+// write atomically replaces the statefile with the encrypted payload.
+// The previous statefile is restored if it can't be replaced.
+func (w *StateWriter) write(payload []byte) error {
+	ciphertext, err := encryptStateFile(payload, w.kdfParams, w.key)
+	if err != nil {
+		return err
+	}
 	out, err := os.OpenFile(w.stateFile+".tmp", os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
 		return err
 	}
 	_, err = out.Write(ciphertext)
+	if err == nil {
+		err = out.Sync()
+	}
 	if err != nil {
+		out.Close()
 		return err
 	}
-	if err := os.Remove(w.stateFile + "~"); err != nil && !os.IsNotExist(err) {
+	if err := out.Close(); err != nil {
 		return err
 	}
-	if err := os.Rename(w.stateFile, w.stateFile+"~"); err != nil && !os.IsNotExist(err) {
+	// The rename replaces the previous statefile in one step, so an
+	// interrupted write leaves either the previous or the new one.
+	if err := os.Rename(w.stateFile+".tmp", w.stateFile); err != nil {
 		return err
 	}
-	if err := os.Rename(w.stateFile+".tmp", w.stateFile); err != nil {
+	if err := syncDir(filepath.Dir(w.stateFile)); err != nil {
 		return err
 	}
+	// Earlier versions moved the previous statefile aside while
+	// writing and may have left it behind.
 	if err := os.Remove(w.stateFile + "~"); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	return nil
 }
 
+// readStateFile reads the statefile, or the previous statefile if an
+// earlier version was interrupted after it moved the previous
+// statefile aside and before it wrote the new one.
+func readStateFile(log *logging.Logger, stateFile string) ([]byte, error) {
+	ciphertext, err := ioutil.ReadFile(stateFile)
+	if !os.IsNotExist(err) {
+		return ciphertext, err
+	}
+	previous, perr := ioutil.ReadFile(stateFile + "~")
+	if perr != nil {
+		return nil, err
+	}
+	log.Warning("Statefile is missing, loading the previous statefile.")
+	return previous, nil
+}
+
+// syncDir flushes the directory entry changes made by renames to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
 func (w *StateWriter) worker() {
 	for {
 		select {
 		case <-w.HaltCh():
+			// Flush the last queued state before terminating.
+			select {
+			case newState := <-w.stateCh:
+				err := w.writeState(newState)
+				if err != nil {
+					w.log.Errorf("Failure to write state to disk: %s", err)
+				}
+			default:
+			}
 			w.log.Debugf("Terminating gracefully.")
 			return
 		case newState := <-w.stateCh:
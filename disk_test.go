@@ -0,0 +1,337 @@
+// disk_test.go - statefile encryption tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/secretbox"
+	"gopkg.in/op/go-logging.v1"
+)
+
+var testLog = logging.MustGetLogger("catshadow_test")
+
+func testStateFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "catshadow_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "catshadow.state")
+}
+
+func encodeTestState(t *testing.T, user string) []byte {
+	var serialized []byte
+	err := codec.NewEncoderBytes(&serialized, cborHandle).Encode(&State{User: user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serialized
+}
+
+// writeLegacyStateFile writes the state in the original statefile
+// format, whose key and nonce are both derived from the passphrase.
+func writeLegacyStateFile(t *testing.T, stateFile string, passphrase, payload []byte) {
+	secret := argon2.Key(passphrase, nil, defaultArgon2Time, defaultArgon2Memory, defaultArgon2Threads, keySize+nonceSize)
+	key := [keySize]byte{}
+	nonce := [nonceSize]byte{}
+	copy(key[:], secret[0:32])
+	copy(nonce[:], secret[32:])
+	ciphertext := secretbox.Seal(nil, payload, &nonce, &key)
+	if err := ioutil.WriteFile(stateFile, ciphertext, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// withKDFParams returns a copy of the statefile
+// with the given argon2 parameters in its header.
+func withKDFParams(data []byte, time, memory uint32, threads uint8) []byte {
+	data = append([]byte{}, data...)
+	binary.BigEndian.PutUint32(data[5+saltSize:], time)
+	binary.BigEndian.PutUint32(data[9+saltSize:], memory)
+	data[13+saltSize] = threads
+	return data
+}
+
+func TestStateFileRoundTrip(t *testing.T) {
+	stateFile := testStateFile(t)
+	defer os.RemoveAll(filepath.Dir(stateFile))
+	passphrase := []byte("correct horse battery staple")
+
+	writer, err := NewStateWriter(testLog, stateFile, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.writeState(encodeTestState(t, "alice")); err != nil {
+		t.Fatal(err)
+	}
+	first, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) < stateFileHeaderLength {
+		t.Fatal("statefile header truncated")
+	}
+	if !bytes.Equal(first[:4], stateFileMagic) {
+		t.Fatalf("bad statefile magic %q", first[:4])
+	}
+	if first[4] != stateFileVersion {
+		t.Fatalf("got statefile version %d, want %d", first[4], stateFileVersion)
+	}
+	if !bytes.Equal(first[5:5+saltSize], writer.kdfParams.salt[:]) {
+		t.Fatal("statefile salt differs")
+	}
+	if binary.BigEndian.Uint32(first[5+saltSize:]) != defaultArgon2Time ||
+		binary.BigEndian.Uint32(first[9+saltSize:]) != defaultArgon2Memory ||
+		first[13+saltSize] != defaultArgon2Threads {
+		t.Fatal("statefile argon2 parameters differ")
+	}
+
+	if err := writer.writeState(encodeTestState(t, "alice")); err != nil {
+		t.Fatal(err)
+	}
+	second, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first[14+saltSize:stateFileHeaderLength], second[14+saltSize:stateFileHeaderLength]) {
+		t.Fatal("statefile nonce was reused")
+	}
+	if _, err := os.Stat(stateFile + "~"); !os.IsNotExist(err) {
+		t.Fatal("previous statefile was left behind")
+	}
+
+	loaded, state, err := LoadStateWriter(testLog, stateFile, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.User != "alice" {
+		t.Fatalf("got user %q, want %q", state.User, "alice")
+	}
+	if *loaded.key != *writer.key || loaded.kdfParams.salt != writer.kdfParams.salt {
+		t.Fatal("loaded statefile key differs")
+	}
+}
+
+func TestStateFileDecryptInvalid(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	params, err := newKDFParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := encryptStateFile([]byte("state"), params, params.deriveKey(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		data       []byte
+		passphrase []byte
+	}{
+		{"wrong passphrase", valid, []byte("wrong passphrase")},
+		{"truncated header", valid[:stateFileHeaderLength-1], passphrase},
+		{"magic only", stateFileMagic, passphrase},
+		{"truncated ciphertext", valid[:len(valid)-1], passphrase},
+		{"unsupported version", func() []byte {
+			data := append([]byte{}, valid...)
+			data[4] = stateFileVersion + 1
+			return data
+		}(), passphrase},
+		{"modified salt", func() []byte {
+			data := append([]byte{}, valid...)
+			data[5] ^= 1
+			return data
+		}(), passphrase},
+		{"zero time", withKDFParams(valid, 0, defaultArgon2Memory, defaultArgon2Threads), passphrase},
+		{"excessive time", withKDFParams(valid, maxArgon2Time+1, defaultArgon2Memory, defaultArgon2Threads), passphrase},
+		{"excessive memory", withKDFParams(valid, defaultArgon2Time, 0xffffffff, defaultArgon2Threads), passphrase},
+		{"zero threads", withKDFParams(valid, defaultArgon2Time, defaultArgon2Memory, 0), passphrase},
+		{"excessive threads", withKDFParams(valid, defaultArgon2Time, defaultArgon2Memory, maxArgon2Threads+1), passphrase},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, _, err := decryptStateFile(test.data, test.passphrase); err == nil {
+				t.Fatal("invalid statefile was decrypted")
+			}
+		})
+	}
+	plaintext, _, _, err := decryptStateFile(valid, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "state" {
+		t.Fatal("decrypted statefile differs")
+	}
+}
+
+func TestStateFileLegacyMigration(t *testing.T) {
+	stateFile := testStateFile(t)
+	defer os.RemoveAll(filepath.Dir(stateFile))
+	passphrase := []byte("correct horse battery staple")
+	writeLegacyStateFile(t, stateFile, passphrase, encodeTestState(t, "bob"))
+
+	if _, _, err := LoadStateWriter(testLog, stateFile, []byte("wrong passphrase")); err == nil {
+		t.Fatal("legacy statefile was decrypted with the wrong passphrase")
+	}
+	_, state, err := LoadStateWriter(testLog, stateFile, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.User != "bob" {
+		t.Fatalf("got user %q, want %q", state.User, "bob")
+	}
+	migrated, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(migrated, stateFileMagic) {
+		t.Fatal("legacy statefile was not migrated")
+	}
+	_, params, _, err := decryptStateFile(migrated, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params == nil {
+		t.Fatal("migrated statefile has no KDF parameters")
+	}
+	_, state, err = LoadStateWriter(testLog, stateFile, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.User != "bob" {
+		t.Fatalf("got user %q, want %q", state.User, "bob")
+	}
+}
+
+func TestStateFileRekey(t *testing.T) {
+	stateFile := testStateFile(t)
+	defer os.RemoveAll(filepath.Dir(stateFile))
+	oldPassphrase := []byte("correct horse battery staple")
+	newPassphrase := []byte("tr0ub4dor&3")
+
+	writer, err := NewStateWriter(testLog, stateFile, oldPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.writeState(encodeTestState(t, "carol")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.Rekey([]byte("wrong passphrase"), newPassphrase); err == nil {
+		t.Fatal("statefile was rekeyed with the wrong passphrase")
+	}
+	if _, _, err := LoadStateWriter(testLog, stateFile, oldPassphrase); err != nil {
+		t.Fatalf("failed rekey changed the statefile: %s", err)
+	}
+
+	// A directory in place of the temporary file makes the write fail.
+	if err := os.Mkdir(stateFile+".tmp", 0700); err != nil {
+		t.Fatal(err)
+	}
+	oldKey := *writer.key
+	if err := writer.Rekey(oldPassphrase, newPassphrase); err == nil {
+		t.Fatal("rekey succeeded although the statefile could not be written")
+	}
+	if *writer.key != oldKey {
+		t.Fatal("failed rekey did not restore the previous key")
+	}
+	if err := os.Remove(stateFile + ".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.writeState(encodeTestState(t, "carol")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadStateWriter(testLog, stateFile, oldPassphrase); err != nil {
+		t.Fatalf("statefile written after a failed rekey is not readable: %s", err)
+	}
+
+	if err := writer.Rekey(oldPassphrase, newPassphrase); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadStateWriter(testLog, stateFile, oldPassphrase); err == nil {
+		t.Fatal("rekeyed statefile was decrypted with the old passphrase")
+	}
+	_, state, err := LoadStateWriter(testLog, stateFile, newPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.User != "carol" {
+		t.Fatalf("got user %q, want %q", state.User, "carol")
+	}
+}
+
+func TestStateFileInterruptedWrite(t *testing.T) {
+	stateFile := testStateFile(t)
+	defer os.RemoveAll(filepath.Dir(stateFile))
+	passphrase := []byte("correct horse battery staple")
+
+	writer, err := NewStateWriter(testLog, stateFile, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.writeState(encodeTestState(t, "dave")); err != nil {
+		t.Fatal(err)
+	}
+	previous, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A write killed before the rename leaves a partial temporary file.
+	if err := ioutil.WriteFile(stateFile+".tmp", previous[:len(previous)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, state, err := LoadStateWriter(testLog, stateFile, passphrase)
+	if err != nil {
+		t.Fatalf("interrupted write damaged the statefile: %s", err)
+	}
+	if state.User != "dave" {
+		t.Fatalf("got user %q, want %q", state.User, "dave")
+	}
+
+	// Earlier versions could be killed with the previous
+	// statefile moved aside and the new one not yet in place.
+	if err := os.Rename(stateFile, stateFile+"~"); err != nil {
+		t.Fatal(err)
+	}
+	loaded, state, err := LoadStateWriter(testLog, stateFile, passphrase)
+	if err != nil {
+		t.Fatalf("previous statefile was not loaded: %s", err)
+	}
+	if state.User != "dave" {
+		t.Fatalf("got user %q, want %q", state.User, "dave")
+	}
+	if err := loaded.writeState(encodeTestState(t, "erin")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stateFile + "~"); !os.IsNotExist(err) {
+		t.Fatal("previous statefile was left behind")
+	}
+	_, state, err = LoadStateWriter(testLog, stateFile, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.User != "erin" {
+		t.Fatalf("got user %q, want %q", state.User, "erin")
+	}
+}
@@ -0,0 +1,230 @@
+// envelope.go - typed and versioned ratchet payload envelope
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/katzenpost/channels"
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	// legacyProtocolVersion is the version of peers which only
+	// understand the baseline format, a single length prefixed text
+	// message per double ratchet payload.
+	legacyProtocolVersion = 0
+
+	// payloadFormatBaseline is the first byte of a double ratchet
+	// payload in the baseline format. The payload starts with the big
+	// endian length of the message, which is shorter than the payload.
+	payloadFormatBaseline byte = 0
+
+	// payloadFormatEnvelope is the first byte of a
+	// double ratchet payload holding an envelope.
+	payloadFormatEnvelope byte = 0xf2
+
+	// envelopeHeaderLength is the length of the header prefixed to an
+	// encoded envelope: a 1 byte payload format and a 4 byte length.
+	envelopeHeaderLength = 1 + 4
+
+	// maxEnvelopeLength is the maximum length of an
+	// encoded envelope carried by a single payload.
+	maxEnvelopeLength = channels.DoubleRatchetPayloadLength - envelopeHeaderLength
+
+	// envelopeVersion is the version of the envelope
+	// format, it is sent to contacts in the key exchange.
+	envelopeVersion = 1
+
+	// envelopeOverhead is an upper bound on the length of the CBOR
+	// encoding of an envelope and of a fragment envelope, excluding
+	// the body.
+	envelopeOverhead = 128
+
+	// envelopeFragmentPayloadLength is the maximum number of bytes
+	// of an encoded envelope carried by a fragment envelope.
+	envelopeFragmentPayloadLength = maxEnvelopeLength - envelopeOverhead
+)
+
+// envelope is the plaintext of a double ratchet payload sent to
+// contacts whose protocol version is at least envelopeVersion.
+// Envelopes too large for a single payload are encoded and split
+// into envelopes of type messageTypeFragment sharing the ID of the
+// envelope they carry.
+type envelope struct {
+	Version  uint8
+	Type     uint8
+	ID       MessageID
+	SentTime int64
+	Body     []byte
+}
+
+// envelopeFragment is the body of an envelope of type messageTypeFragment.
+type envelopeFragment struct {
+	Index uint32
+	Count uint32
+	Data  []byte
+}
+
+func newEnvelope(messageType uint8, id MessageID, body []byte) *envelope {
+	return &envelope{
+		Version:  envelopeVersion,
+		Type:     messageType,
+		ID:       id,
+		SentTime: time.Now().Unix(),
+		Body:     body,
+	}
+}
+
+// sentTime returns the time the envelope was sent
+// according to the sender's clock.
+func (e *envelope) sentTime() time.Time {
+	return time.Unix(e.SentTime, 0)
+}
+
+func (e *envelope) encode() ([]byte, error) {
+	var serialized []byte
+	err := codec.NewEncoderBytes(&serialized, cborHandle).Encode(e)
+	if err != nil {
+		return nil, err
+	}
+	return serialized, nil
+}
+
+func decodeEnvelope(serialized []byte) (*envelope, error) {
+	e := new(envelope)
+	err := codec.NewDecoderBytes(serialized, cborHandle).Decode(e)
+	if err != nil {
+		return nil, err
+	}
+	if e.Version < envelopeVersion {
+		return nil, errors.New("invalid envelope version")
+	}
+	return e, nil
+}
+
+// payloads returns the envelope encoded and padded to the double ratchet
+// payload length, split into fragment envelopes if it is too large.
+func (e *envelope) payloads() ([][]byte, error) {
+	if len(e.Body) > MaxMessageLength {
+		return nil, errMessageTooLarge
+	}
+	serialized, err := e.encode()
+	if err != nil {
+		return nil, err
+	}
+	if len(serialized) <= maxEnvelopeLength {
+		return [][]byte{padEnvelope(serialized)}, nil
+	}
+	count := (len(serialized) + envelopeFragmentPayloadLength - 1) / envelopeFragmentPayloadLength
+	payloads := [][]byte{}
+	for i := 0; i < count; i++ {
+		end := (i + 1) * envelopeFragmentPayloadLength
+		if end > len(serialized) {
+			end = len(serialized)
+		}
+		var body []byte
+		err = codec.NewEncoderBytes(&body, cborHandle).Encode(&envelopeFragment{
+			Index: uint32(i),
+			Count: uint32(count),
+			Data:  serialized[i*envelopeFragmentPayloadLength : end],
+		})
+		if err != nil {
+			return nil, err
+		}
+		fragmentEnvelope := newEnvelope(messageTypeFragment, e.ID, body)
+		encoded, err := fragmentEnvelope.encode()
+		if err != nil {
+			return nil, err
+		}
+		if len(encoded) > maxEnvelopeLength {
+			return nil, errors.New("fragment envelope exceeds payload length")
+		}
+		payloads = append(payloads, padEnvelope(encoded))
+	}
+	return payloads, nil
+}
+
+// fragment returns the fragment carried by an
+// envelope of type messageTypeFragment.
+func (e *envelope) fragment() (*fragment, error) {
+	ef := new(envelopeFragment)
+	err := codec.NewDecoderBytes(e.Body, cborHandle).Decode(ef)
+	if err != nil {
+		return nil, err
+	}
+	if ef.Count == 0 || ef.Count > maxFragments || ef.Index >= ef.Count {
+		return nil, errors.New("invalid fragment index")
+	}
+	return &fragment{
+		Type:      messageTypeFragment,
+		MessageID: e.ID,
+		Index:     ef.Index,
+		Count:     ef.Count,
+		Data:      ef.Data,
+	}, nil
+}
+
+// padPayload prefixes the message with its length and pads it to the
+// double ratchet payload length, which is the baseline payload format.
+func padPayload(message []byte) []byte {
+	payload := make([]byte, channels.DoubleRatchetPayloadLength)
+	binary.BigEndian.PutUint32(payload[:4], uint32(len(message)))
+	copy(payload[4:], message)
+	return payload
+}
+
+// unpadPayload returns the message of a payload in the baseline format.
+func unpadPayload(payload []byte) ([]byte, error) {
+	if len(payload) < 4 {
+		return nil, errors.New("payload too short")
+	}
+	payloadLen := binary.BigEndian.Uint32(payload[:4])
+	if int64(payloadLen) > int64(len(payload)-4) {
+		return nil, errors.New("invalid payload length")
+	}
+	return payload[4 : 4+payloadLen], nil
+}
+
+// padEnvelope prefixes the encoded envelope with the payload format
+// and its length and pads it to the double ratchet payload length.
+func padEnvelope(serialized []byte) []byte {
+	payload := make([]byte, channels.DoubleRatchetPayloadLength)
+	payload[0] = payloadFormatEnvelope
+	binary.BigEndian.PutUint32(payload[1:envelopeHeaderLength], uint32(len(serialized)))
+	copy(payload[envelopeHeaderLength:], serialized)
+	return payload
+}
+
+// unpadEnvelope returns the encoded envelope held by the payload.
+func unpadEnvelope(payload []byte) ([]byte, error) {
+	if len(payload) < envelopeHeaderLength || payload[0] != payloadFormatEnvelope {
+		return nil, errors.New("payload is not an envelope")
+	}
+	return unpadPayload(payload[1:])
+}
+
+// payloadFormat returns the format of the double
+// ratchet payload, given by its first byte.
+func payloadFormat(payload []byte) (byte, error) {
+	if len(payload) == 0 {
+		return 0, errors.New("payload too short")
+	}
+	return payload[0], nil
+}
@@ -0,0 +1,207 @@
+// envelope_test.go - payload format tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/katzenpost/channels"
+)
+
+// baselinePayload returns the payload sent by the baseline
+// release, which only knew of length prefixed text messages.
+func baselinePayload(message []byte) []byte {
+	payload := [channels.DoubleRatchetPayloadLength]byte{}
+	binary.BigEndian.PutUint32(payload[:4], uint32(len(message)))
+	copy(payload[4:], message)
+	return payload[:]
+}
+
+func TestBaselinePayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		message []byte
+	}{
+		{"empty", []byte{}},
+		{"text", []byte("hello, is this thing on?")},
+		{"control bytes", []byte{0, 1, 2, 3, 4}},
+		{"format bytes", []byte{payloadFormatEnvelope, 0xff}},
+		{"maximum length", testMessage(channels.DoubleRatchetPayloadLength - 4)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload := baselinePayload(test.message)
+			format, err := payloadFormat(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != payloadFormatBaseline {
+				t.Fatalf("got payload format %d, want %d", format, payloadFormatBaseline)
+			}
+			message, err := unpadPayload(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(message, test.message) {
+				t.Fatal("decoded message differs")
+			}
+		})
+	}
+}
+
+func TestEncodeBaselinePayload(t *testing.T) {
+	c := new(Client)
+	contact := &Contact{nickname: "alice", peerVersion: legacyProtocolVersion}
+	message := []byte("hello alice")
+	payloads, err := c.encodePayload(contact, messageTypeText, newMessageID(), message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payloads) != 1 {
+		t.Fatalf("got %d payloads, want 1", len(payloads))
+	}
+	if !bytes.Equal(payloads[0], baselinePayload(message)) {
+		t.Fatal("payload differs from the baseline format")
+	}
+
+	tests := []struct {
+		name        string
+		messageType uint8
+		message     []byte
+	}{
+		{"acknowledgement", messageTypeAck, make([]byte, 8)},
+		{"control message", messageTypeControl, []byte{0xa0}},
+		{"file", messageTypeFile, []byte{0xa0}},
+		{"too large", messageTypeText, testMessage(channels.DoubleRatchetPayloadLength - 3)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := c.encodePayload(contact, test.messageType, newMessageID(), test.message)
+			if err == nil {
+				t.Fatal("unsupported message was encoded")
+			}
+		})
+	}
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		length int
+	}{
+		{"empty", 0},
+		{"short", 100},
+		{"fragmented", 3 * channels.DoubleRatchetPayloadLength},
+		{"maximum length", MaxMessageLength},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := testMessage(test.length)
+			id := newMessageID()
+			payloads, err := newEnvelope(messageTypeText, id, message).payloads()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var partial *partialMessage
+			var decoded *envelope
+			for _, payload := range payloads {
+				if len(payload) != channels.DoubleRatchetPayloadLength {
+					t.Fatalf("payload length is %d", len(payload))
+				}
+				format, err := payloadFormat(payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if format != payloadFormatEnvelope {
+					t.Fatalf("got payload format %d, want %d", format, payloadFormatEnvelope)
+				}
+				serialized, err := unpadEnvelope(payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				e, err := decodeEnvelope(serialized)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if e.ID != id {
+					t.Fatal("envelope ID differs")
+				}
+				if e.Type != messageTypeFragment {
+					decoded = e
+					continue
+				}
+				f, err := e.fragment()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if partial == nil {
+					partial = newPartialMessage(1, f)
+				}
+				complete, err := partial.add(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if complete {
+					decoded, err = decodeEnvelope(partial.reassemble())
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if decoded == nil {
+				t.Fatal("envelope not decoded")
+			}
+			if decoded.Type != messageTypeText || !bytes.Equal(decoded.Body, message) {
+				t.Fatal("decoded envelope differs")
+			}
+		})
+	}
+}
+
+func TestEnvelopeTooLarge(t *testing.T) {
+	_, err := newEnvelope(messageTypeText, 1, testMessage(MaxMessageLength+1)).payloads()
+	if err != errMessageTooLarge {
+		t.Fatalf("got %v, want %v", err, errMessageTooLarge)
+	}
+}
+
+func TestUnpadInvalidPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		unpad   func([]byte) ([]byte, error)
+	}{
+		{"short baseline", []byte{0, 0, 0}, unpadPayload},
+		{"baseline length", []byte{0, 0, 0, 5, 1, 2}, unpadPayload},
+		{"baseline length overflow", []byte{0xff, 0xff, 0xff, 0xff, 1}, unpadPayload},
+		{"short envelope", []byte{payloadFormatEnvelope, 0, 0}, unpadEnvelope},
+		{"envelope length", []byte{payloadFormatEnvelope, 0, 0, 0, 5, 1}, unpadEnvelope},
+		{"baseline envelope", baselinePayload([]byte("hello")), unpadEnvelope},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.unpad(test.payload); err == nil {
+				t.Fatal("invalid payload was accepted")
+			}
+		})
+	}
+	if _, err := payloadFormat(nil); err == nil {
+		t.Fatal("empty payload was accepted")
+	}
+}
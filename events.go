@@ -0,0 +1,288 @@
+// events.go - client events
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"fmt"
+	"time"
+)
+
+// eventSinkSize is the number of events buffered for the
+// application before further events are dropped.
+const eventSinkSize = 128
+
+// Event is the interface implemented by all events
+// emitted on the Client's event sink.
+type Event interface {
+	// String returns a string representation of the Event.
+	String() string
+}
+
+// MessageReceivedEvent is the event sent when a new
+// message is added to the inbox.
+type MessageReceivedEvent struct {
+	// Nickname is the nickname of the contact who sent the message.
+	Nickname string
+
+	// MessageID is the ID of the message in the inbox,
+	// it is passed to ReadMessage.
+	MessageID MessageID
+
+	// Message is the received message.
+	Message []byte
+
+	// ReceivedTime is the time the message was received.
+	ReceivedTime time.Time
+
+	// SentTime is the time the message was sent according to the
+	// sender's clock, it is zero if the sender didn't include it.
+	SentTime time.Time
+}
+
+// String returns a string representation of the MessageReceivedEvent.
+func (e *MessageReceivedEvent) String() string {
+	return fmt.Sprintf("MessageReceived: from %s (%d bytes)", e.Nickname, len(e.Message))
+}
+
+// MessageSentEvent is the event sent when a message has been
+// written to a contact's spool or when writing it failed.
+type MessageSentEvent struct {
+	// Nickname is the nickname of the recipient of the message.
+	Nickname string
+
+	// MessageID is the ID returned by SendMessage.
+	MessageID MessageID
+
+	// Err is the error encountered when sending the message if any.
+	// Failed spool writes are retried, the message status reports
+	// whether the message was given up on.
+	Err error
+}
+
+// String returns a string representation of the MessageSentEvent.
+func (e *MessageSentEvent) String() string {
+	if e.Err != nil {
+		return fmt.Sprintf("MessageSent: %s to %s failed: %v", e.MessageID, e.Nickname, e.Err)
+	}
+	return fmt.Sprintf("MessageSent: %s to %s", e.MessageID, e.Nickname)
+}
+
+// MessageDeliveredEvent is the event sent when a contact
+// acknowledges receipt of a message.
+type MessageDeliveredEvent struct {
+	// Nickname is the nickname of the recipient of the message.
+	Nickname string
+
+	// MessageID is the ID returned by SendMessage.
+	MessageID MessageID
+}
+
+// String returns a string representation of the MessageDeliveredEvent.
+func (e *MessageDeliveredEvent) String() string {
+	return fmt.Sprintf("MessageDelivered: %s to %s", e.MessageID, e.Nickname)
+}
+
+// KeyExchangeCompletedEvent is the event sent when a
+// contact's key exchange completed successfully.
+type KeyExchangeCompletedEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+}
+
+// String returns a string representation of the KeyExchangeCompletedEvent.
+func (e *KeyExchangeCompletedEvent) String() string {
+	return fmt.Sprintf("KeyExchangeCompleted: %s", e.Nickname)
+}
+
+// KeyExchangeFailedEvent is the event sent when a
+// contact's key exchange failed.
+type KeyExchangeFailedEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+
+	// Err is the reason the key exchange failed.
+	Err error
+}
+
+// String returns a string representation of the KeyExchangeFailedEvent.
+func (e *KeyExchangeFailedEvent) String() string {
+	return fmt.Sprintf("KeyExchangeFailed: %s: %v", e.Nickname, e.Err)
+}
+
+// ConnectionStatusChangedEvent is the event sent when the Client
+// gains or loses its ability to reach the mixnet. It carries the
+// same information as the session's ConnectionStatusEvent, but it
+// is derived from the outcome of the Client's spool round trips.
+type ConnectionStatusChangedEvent struct {
+	// IsConnected is true iff the last spool round trip got a reply.
+	IsConnected bool
+
+	// Err is the error encountered by the last round trip if any.
+	Err error
+}
+
+// String returns a string representation of the ConnectionStatusChangedEvent.
+func (e *ConnectionStatusChangedEvent) String() string {
+	if !e.IsConnected {
+		return fmt.Sprintf("ConnectionStatus: %v (%v)", e.IsConnected, e.Err)
+	}
+	return fmt.Sprintf("ConnectionStatus: %v", e.IsConnected)
+}
+
+// SpoolLostEvent is the event sent when the remote spool a
+// contact writes to is found to no longer exist, which happens
+// when the Provider is restarted.
+type SpoolLostEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+
+	// Err is the error returned by the spool service.
+	Err error
+}
+
+// String returns a string representation of the SpoolLostEvent.
+func (e *SpoolLostEvent) String() string {
+	return fmt.Sprintf("SpoolLost: %s: %v", e.Nickname, e.Err)
+}
+
+// SpoolRecoveredEvent is the event sent when a lost spool has
+// been replaced and the new spool was sent to the contact.
+type SpoolRecoveredEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+}
+
+// String returns a string representation of the SpoolRecoveredEvent.
+func (e *SpoolRecoveredEvent) String() string {
+	return fmt.Sprintf("SpoolRecovered: %s", e.Nickname)
+}
+
+// FileOfferedEvent is the event sent when a contact offers us a
+// file, it is received once the offer is accepted with AcceptFile.
+type FileOfferedEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+
+	// TransferID identifies the transfer.
+	TransferID MessageID
+
+	// Name is the name of the file.
+	Name string
+
+	// Size is the size of the file in bytes.
+	Size uint64
+}
+
+// String returns a string representation of the FileOfferedEvent.
+func (e *FileOfferedEvent) String() string {
+	return fmt.Sprintf("FileOffered: %s from %s: %s (%d bytes)", e.TransferID, e.Nickname, e.Name, e.Size)
+}
+
+// FileTransferCompletedEvent is the event sent when a
+// file transfer with a contact completes or fails.
+type FileTransferCompletedEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+
+	// TransferID identifies the transfer.
+	TransferID MessageID
+
+	// Name is the name of the file.
+	Name string
+
+	// Path is where a received file was written.
+	Path string
+
+	// Err is the reason the transfer failed if any.
+	Err error
+}
+
+// String returns a string representation of the FileTransferCompletedEvent.
+func (e *FileTransferCompletedEvent) String() string {
+	if e.Err != nil {
+		return fmt.Sprintf("FileTransferCompleted: %s with %s failed: %v", e.TransferID, e.Nickname, e.Err)
+	}
+	return fmt.Sprintf("FileTransferCompleted: %s with %s", e.TransferID, e.Nickname)
+}
+
+// RetentionChangedEvent is the event sent when a contact
+// changes the retention period of our conversation.
+type RetentionChangedEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+
+	// Retention is the new retention period, zero
+	// reverts to the Client's default retention period.
+	Retention time.Duration
+}
+
+// String returns a string representation of the RetentionChangedEvent.
+func (e *RetentionChangedEvent) String() string {
+	return fmt.Sprintf("RetentionChanged: %s: %s", e.Nickname, e.Retention)
+}
+
+// IntroductionReceivedEvent is the event sent when a contact introduces
+// us to one of its contacts, the introduced contact is added once the
+// introduction is accepted with AcceptIntroduction.
+type IntroductionReceivedEvent struct {
+	// Introducer is the nickname of the contact
+	// who made the introduction.
+	Introducer string
+
+	// ID identifies the introduction.
+	ID MessageID
+
+	// Nickname is the introducer's nickname
+	// for the introduced contact.
+	Nickname string
+}
+
+// String returns a string representation of the IntroductionReceivedEvent.
+func (e *IntroductionReceivedEvent) String() string {
+	return fmt.Sprintf("IntroductionReceived: %s from %s: %s", e.ID, e.Introducer, e.Nickname)
+}
+
+// EventSink returns the channel on which the Client emits
+// its events. Events are dropped if the channel is not read.
+func (c *Client) EventSink() <-chan Event {
+	return c.eventCh
+}
+
+func (c *Client) emitEvent(event Event) {
+	select {
+	case c.eventCh <- event:
+	default:
+		c.log.Warningf("event sink is full, dropping event: %s", event)
+	}
+}
+
+// updateConnectionStatus tracks whether spool round trips are
+// getting replies and emits an event when this changes.
+func (c *Client) updateConnectionStatus(err error) {
+	isConnected := err == nil || isSpoolCommandFailure(err)
+	if isConnected == c.isConnected {
+		return
+	}
+	c.isConnected = isConnected
+	if isConnected {
+		err = nil
+	}
+	c.emitEvent(&ConnectionStatusChangedEvent{
+		IsConnected: isConnected,
+		Err:         err,
+	})
+}
@@ -0,0 +1,70 @@
+// events_test.go - event sink tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventSink(t *testing.T) {
+	spools := newFakeSpoolService()
+	alice := newTestClient(t, "alice", spools)
+	bob := newTestClient(t, "bob", spools)
+	pairTestClients(t, alice, bob)
+	alice.Go(alice.worker)
+	defer alice.Halt()
+
+	id := alice.SendMessage("bob", []byte("hello bob"))
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e := <-alice.EventSink():
+			sent, ok := e.(*MessageSentEvent)
+			if !ok {
+				continue
+			}
+			if sent.MessageID != id || sent.Nickname != "bob" || sent.Err != nil {
+				t.Fatalf("got %s", sent)
+			}
+			return
+		case <-timeout:
+			t.Fatal("timed out waiting for the message sent event")
+		}
+	}
+}
+
+func TestEventSinkFull(t *testing.T) {
+	c := &Client{
+		log:     testLog,
+		eventCh: make(chan Event, 1),
+	}
+	done := make(chan struct{})
+	go func() {
+		c.emitEvent(&MessageSentEvent{Nickname: "alice", MessageID: 1})
+		c.emitEvent(&MessageSentEvent{Nickname: "alice", MessageID: 2})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("emitting an event blocked on a full event sink")
+	}
+	if e := (<-c.EventSink()).(*MessageSentEvent); e.MessageID != 1 {
+		t.Fatalf("got %s, want the first event", e)
+	}
+}
@@ -0,0 +1,245 @@
+// exchange.go - out-of-band contact exchange
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/katzenpost/channels"
+	"github.com/katzenpost/core/crypto/rand"
+	ratchet "github.com/katzenpost/doubleratchet"
+)
+
+// contactExchangePEMType is the PEM block type
+// of an armored contact exchange.
+const contactExchangePEMType = "CATSHADOW CONTACT EXCHANGE"
+
+type exportContactExchange struct {
+	Name         string
+	ResponseChan chan contactExchangeResult
+}
+
+type contactExchangeResult struct {
+	Exchange []byte
+	Err      error
+}
+
+type importContactExchange struct {
+	Name         string
+	Exchange     []byte
+	ResponseChan chan error
+}
+
+// ArmorContactExchange returns the contact exchange
+// as a PEM encoded block of text.
+func ArmorContactExchange(exchange []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  contactExchangePEMType,
+		Bytes: exchange,
+	}))
+}
+
+// UnarmorContactExchange returns the contact exchange
+// contained in the PEM encoded block of text.
+func UnarmorContactExchange(armored string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(armored))
+	if block == nil {
+		return nil, errors.New("no armored contact exchange found")
+	}
+	if block.Type != contactExchangePEMType {
+		return nil, fmt.Errorf("unexpected armor type %s", block.Type)
+	}
+	return block.Bytes, nil
+}
+
+// AddManualContact adds a new contact whose key exchange is done out
+// of band rather than with PANDA, which doesn't need to be configured.
+// Our contact exchange is exported with ExportContactExchange and
+// given to the contact, whose own contact exchange completes the key
+// exchange when it is imported with ImportContactExchange.
+func (c *Client) AddManualContact(ctx context.Context, nickname string) error {
+	spoolReaderChan, err := c.newContactSpoolContext(ctx)
+	if err != nil {
+		return err
+	}
+	responseChan := make(chan error, 1)
+	select {
+	case c.addContactChan <- addContact{
+		Name:            nickname,
+		Manual:          true,
+		SpoolReaderChan: spoolReaderChan,
+		ResponseChan:    responseChan,
+	}:
+	case <-ctx.Done():
+		go c.purgeSpool(spoolReaderChan)
+		return ctx.Err()
+	case <-c.HaltCh():
+		go c.purgeSpool(spoolReaderChan)
+		return errHalted
+	}
+	return c.waitResponse(ctx, responseChan)
+}
+
+// ExportContactExchange returns our armored contact exchange for the
+// pending contact with the given nickname, added with AddManualContact.
+func (c *Client) ExportContactExchange(ctx context.Context, nickname string) (string, error) {
+	responseChan := make(chan contactExchangeResult, 1)
+	select {
+	case c.exportContactExchangeChan <- exportContactExchange{
+		Name:         nickname,
+		ResponseChan: responseChan,
+	}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-c.HaltCh():
+		return "", errHalted
+	}
+	select {
+	case result := <-responseChan:
+		if result.Err != nil {
+			return "", result.Err
+		}
+		return ArmorContactExchange(result.Exchange), nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-c.HaltCh():
+		return "", errHalted
+	}
+}
+
+// ImportContactExchange completes the key exchange with the pending
+// contact with the given nickname, added with AddManualContact, using
+// the armored contact exchange exported by the contact.
+func (c *Client) ImportContactExchange(ctx context.Context, nickname, armored string) error {
+	exchange, err := UnarmorContactExchange(armored)
+	if err != nil {
+		return err
+	}
+	if _, err := parseContactExchangeBytes(exchange); err != nil {
+		return fmt.Errorf("failure to parse contact exchange bytes: %s", err)
+	}
+	responseChan := make(chan error, 1)
+	select {
+	case c.importContactExchangeChan <- importContactExchange{
+		Name:         nickname,
+		Exchange:     exchange,
+		ResponseChan: responseChan,
+	}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.HaltCh():
+		return errHalted
+	}
+	return c.waitResponse(ctx, responseChan)
+}
+
+func (c *Client) createManualContact(nickname string, spoolReaderChan *channels.UnreliableSpoolReaderChannel) error {
+	if _, ok := c.contactNicknames[nickname]; ok {
+		go c.purgeSpool(spoolReaderChan)
+		return fmt.Errorf("Contact with nickname %s, already exists.", nickname)
+	}
+	contact, err := NewContact(nickname, c.randID(), spoolReaderChan, c.session)
+	if err != nil {
+		go c.purgeSpool(spoolReaderChan)
+		return err
+	}
+	c.contacts[contact.ID()] = contact
+	c.contactNicknames[contact.nickname] = contact
+	c.log.Infof("New manual key exchange with %s, waiting for the contact's exchange.", nickname)
+	c.save()
+	return nil
+}
+
+// manualExchangeContact returns the pending contact with the given
+// nickname if it is waiting for a contact exchange to be imported.
+func (c *Client) manualExchangeContact(nickname string) (*Contact, error) {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return nil, fmt.Errorf("contact %s not found", nickname)
+	}
+	if !contact.isPending {
+		return nil, fmt.Errorf("key exchange with %s has already completed", nickname)
+	}
+	if contact.pandaKeyExchange != nil {
+		return nil, fmt.Errorf("PANDA key exchange with %s is in progress", nickname)
+	}
+	if contact.keyExchange == nil {
+		return nil, fmt.Errorf("key exchange with %s is not a manual key exchange", nickname)
+	}
+	return contact, nil
+}
+
+func (c *Client) doExportContactExchange(nickname string) ([]byte, error) {
+	contact, err := c.manualExchangeContact(nickname)
+	if err != nil {
+		return nil, err
+	}
+	return contact.keyExchange, nil
+}
+
+// checkContactExchange processes the contact exchange with a copy of
+// the contact's double ratchet, so that an exchange which can't complete
+// the key exchange is rejected while the contact is left waiting for a
+// corrected one.
+func checkContactExchange(contact *Contact, exchangeBytes []byte) error {
+	exchange, err := parseContactExchangeBytes(exchangeBytes)
+	if err != nil {
+		return fmt.Errorf("failure to parse contact exchange bytes: %s", err)
+	}
+	if exchange.SpoolWriter == nil || exchange.SignedKeyExchange == nil {
+		return errors.New("incomplete contact exchange")
+	}
+	serialized, err := contact.ratchet.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	r, err := ratchet.New(rand.Reader)
+	if err != nil {
+		return err
+	}
+	err = r.UnmarshalBinary(serialized)
+	if err != nil {
+		return err
+	}
+	err = r.ProcessKeyExchange(exchange.SignedKeyExchange)
+	if err != nil {
+		return fmt.Errorf("Double ratchet key exchange failure: %s", err)
+	}
+	return nil
+}
+
+func (c *Client) doImportContactExchange(nickname string, exchange []byte) error {
+	contact, err := c.manualExchangeContact(nickname)
+	if err != nil {
+		return err
+	}
+	err = checkContactExchange(contact, exchange)
+	if err != nil {
+		return err
+	}
+	c.completeKeyExchange(contact, exchange)
+	if contact.pandaResult != "" {
+		c.save()
+		return errors.New(contact.pandaResult)
+	}
+	contact.keyExchange = nil
+	c.save()
+	return nil
+}
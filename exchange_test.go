@@ -0,0 +1,86 @@
+// exchange_test.go - out-of-band contact exchange tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"testing"
+
+	"github.com/katzenpost/channels"
+	"github.com/katzenpost/core/crypto/rand"
+	ratchet "github.com/katzenpost/doubleratchet"
+)
+
+func newTestKeyExchange(t *testing.T) (*ratchet.Ratchet, *ratchet.SignedKeyExchange) {
+	r, err := ratchet.New(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kx, err := r.CreateKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, kx
+}
+
+func TestCheckContactExchange(t *testing.T) {
+	r, _ := newTestKeyExchange(t)
+	contact := &Contact{ratchet: r}
+	_, peerKx := newTestKeyExchange(t)
+	writer := &channels.UnreliableSpoolWriterChannel{
+		SpoolID:       []byte("spool"),
+		SpoolReceiver: "spool",
+		SpoolProvider: "provider",
+	}
+	exchange := func(writer *channels.UnreliableSpoolWriterChannel, kx *ratchet.SignedKeyExchange) []byte {
+		exchange, err := NewContactExchangeBytes(writer, kx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exchange
+	}
+	tampered := &ratchet.SignedKeyExchange{
+		Signed:    peerKx.Signed,
+		Signature: append([]byte{}, peerKx.Signature...),
+	}
+	tampered.Signature[0] ^= 1
+
+	tests := []struct {
+		name     string
+		exchange []byte
+	}{
+		{"garbage", []byte("not a contact exchange")},
+		{"missing spool", exchange(nil, peerKx)},
+		{"missing key exchange", exchange(writer, nil)},
+		{"bad signature", exchange(writer, tampered)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := checkContactExchange(contact, test.exchange); err == nil {
+				t.Fatal("invalid contact exchange was accepted")
+			}
+		})
+	}
+
+	// The failed attempts must not have touched the contact's ratchet.
+	valid := exchange(writer, peerKx)
+	if err := checkContactExchange(contact, valid); err != nil {
+		t.Fatal(err)
+	}
+	if err := contact.ratchet.ProcessKeyExchange(peerKx); err != nil {
+		t.Fatalf("ratchet was changed by a checked exchange: %s", err)
+	}
+}
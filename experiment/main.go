@@ -82,8 +82,8 @@ func createClient(cfg *config.Config, stateFile string, try int) *catshadow.Clie
 		if err != nil {
 			return retryConnect(err, cfg, stateFile, try)
 		}
-		fmt.Println("creating remote message receiver spool")
-		cli, err = catshadow.NewClientAndRemoteSpool(sendC.GetBackendLog(), sendC, stateWorker, user, linkKey)
+		fmt.Println("creating catshadow client")
+		cli, err = catshadow.NewClientAndState(sendC.GetBackendLog(), sendC, stateWorker, user, linkKey)
 		if err != nil {
 			return retryConnect(err, cfg, stateFile, try)
 		}
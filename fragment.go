@@ -0,0 +1,138 @@
+// fragment.go - message fragmentation and reassembly
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/katzenpost/core/crypto/rand"
+)
+
+const (
+	// maxFragments is the maximum number of fragment
+	// envelopes a message may be split into.
+	maxFragments = 64
+
+	// MaxMessageLength is the maximum length of a message which
+	// can be sent to a contact. The encoded envelope carrying it
+	// fits in maxFragments fragment envelopes.
+	MaxMessageLength = maxFragments*envelopeFragmentPayloadLength - envelopeOverhead
+
+	// partialMessageTimeout is how long we keep the fragments of an
+	// incomplete message around before giving up on the rest.
+	partialMessageTimeout = 7 * 24 * time.Hour
+)
+
+const (
+	// messageTypeText is a message composed by the user.
+	messageTypeText uint8 = iota
+	// messageTypeAck acknowledges the delivery of a text message,
+	// its body is the ID of the acknowledged message.
+	messageTypeAck
+	// messageTypeControl is a CBOR encoded controlMessage.
+	messageTypeControl
+	// messageTypeFragment is a piece of a larger envelope, it
+	// is only sent in envelopes.
+	messageTypeFragment
+	// messageTypeFile is a file transfer message, it is only
+	// sent in envelopes.
+	messageTypeFile
+	// messageTypeIntroduction is an introduction to another
+	// contact, it is only sent in envelopes.
+	messageTypeIntroduction
+)
+
+var errMessageTooLarge = fmt.Errorf("message exceeds maximum length of %d bytes", MaxMessageLength)
+
+// fragment is a piece of an encoded envelope too large to be
+// encrypted by the double ratchet as a single payload. Fragments
+// are carried in envelopes of type messageTypeFragment.
+type fragment struct {
+	Type      uint8
+	MessageID MessageID
+	Index     uint32
+	Count     uint32
+	Data      []byte
+}
+
+// newMessageID returns a random message ID.
+func newMessageID() MessageID {
+	var idBytes [8]byte
+	_, err := rand.Reader.Read(idBytes[:])
+	if err != nil {
+		panic(err)
+	}
+	return MessageID(binary.LittleEndian.Uint64(idBytes[:]))
+}
+
+// partialMessage holds the fragments received so far
+// of a message which has not been fully reassembled.
+type partialMessage struct {
+	ContactID    uint64
+	Type         uint8
+	MessageID    MessageID
+	Fragments    [][]byte
+	Received     uint32
+	ReceivedTime time.Time
+}
+
+func newPartialMessage(contactID uint64, f *fragment) *partialMessage {
+	return &partialMessage{
+		ContactID:    contactID,
+		Type:         f.Type,
+		MessageID:    f.MessageID,
+		Fragments:    make([][]byte, f.Count),
+		ReceivedTime: time.Now(),
+	}
+}
+
+// add stores the given fragment and returns true
+// once all the fragments have been received.
+func (p *partialMessage) add(f *fragment) (bool, error) {
+	if int(f.Count) != len(p.Fragments) {
+		return false, errors.New("fragment count mismatch")
+	}
+	if f.Type != p.Type {
+		return false, errors.New("fragment type mismatch")
+	}
+	if int(f.Index) >= len(p.Fragments) {
+		return false, errors.New("invalid fragment index")
+	}
+	if p.Fragments[f.Index] == nil {
+		p.Fragments[f.Index] = append([]byte{}, f.Data...)
+		p.Received++
+	}
+	return p.Received == uint32(len(p.Fragments)), nil
+}
+
+// reassemble returns the message made up of all the fragments.
+func (p *partialMessage) reassemble() []byte {
+	message := []byte{}
+	for _, data := range p.Fragments {
+		message = append(message, data...)
+	}
+	return message
+}
+
+// isExpired returns true if we've given up waiting
+// for the remaining fragments.
+func (p *partialMessage) isExpired(now time.Time) bool {
+	return now.Sub(p.ReceivedTime) > partialMessageTimeout
+}
@@ -0,0 +1,161 @@
+// fragment_test.go - message fragmentation tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+func testMessage(length int) []byte {
+	message := make([]byte, length)
+	for i := range message {
+		message[i] = byte(i % 251)
+	}
+	return message
+}
+
+// testFragments splits the message into fragments of the given length.
+func testFragments(id MessageID, message []byte, length int) []*fragment {
+	count := (len(message) + length - 1) / length
+	fragments := make([]*fragment, count)
+	for i := range fragments {
+		end := (i + 1) * length
+		if end > len(message) {
+			end = len(message)
+		}
+		fragments[i] = &fragment{
+			Type:      messageTypeFragment,
+			MessageID: id,
+			Index:     uint32(i),
+			Count:     uint32(count),
+			Data:      message[i*length : end],
+		}
+	}
+	return fragments
+}
+
+func TestEnvelopeFragmentCount(t *testing.T) {
+	payloads, err := newEnvelope(messageTypeText, 1, testMessage(MaxMessageLength)).payloads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payloads) > maxFragments {
+		t.Fatalf("got %d fragments, want at most %d", len(payloads), maxFragments)
+	}
+}
+
+func TestEnvelopeFragmentInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		ef   *envelopeFragment
+	}{
+		{"zero count", &envelopeFragment{Index: 0, Count: 0}},
+		{"too many fragments", &envelopeFragment{Index: 0, Count: maxFragments + 1}},
+		{"index out of range", &envelopeFragment{Index: 2, Count: 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var body []byte
+			if err := codec.NewEncoderBytes(&body, cborHandle).Encode(test.ef); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := newEnvelope(messageTypeFragment, 1, body).fragment(); err == nil {
+				t.Fatal("invalid fragment was accepted")
+			}
+		})
+	}
+}
+
+func TestPartialMessageOrder(t *testing.T) {
+	message := testMessage(3*envelopeFragmentPayloadLength + 10)
+	fragments := testFragments(7, message, envelopeFragmentPayloadLength)
+	if len(fragments) != 4 {
+		t.Fatalf("got %d fragments, want 4", len(fragments))
+	}
+	tests := []struct {
+		name  string
+		order []int
+	}{
+		{"in order", []int{0, 1, 2, 3}},
+		{"reversed", []int{3, 2, 1, 0}},
+		{"shuffled", []int{2, 0, 3, 1}},
+		{"duplicates", []int{1, 1, 0, 2, 0, 3}},
+		{"duplicate after completion", []int{0, 1, 2, 3, 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			partial := newPartialMessage(1, fragments[test.order[0]])
+			received := map[int]bool{}
+			for _, i := range test.order {
+				complete, err := partial.add(fragments[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				received[i] = true
+				if complete != (len(received) == len(fragments)) {
+					t.Fatalf("complete is %v after %d of %d fragments", complete, len(received), len(fragments))
+				}
+				if int(partial.Received) != len(received) {
+					t.Fatalf("received count is %d, want %d", partial.Received, len(received))
+				}
+			}
+			if !bytes.Equal(partial.reassemble(), message) {
+				t.Fatal("reassembled message differs")
+			}
+		})
+	}
+}
+
+func TestPartialMessageMismatch(t *testing.T) {
+	first := &fragment{Type: messageTypeText, MessageID: 1, Index: 0, Count: 2, Data: []byte("a")}
+	tests := []struct {
+		name string
+		f    *fragment
+	}{
+		{"count", &fragment{Type: messageTypeText, MessageID: 1, Index: 1, Count: 3, Data: []byte("b")}},
+		{"type", &fragment{Type: messageTypeControl, MessageID: 1, Index: 1, Count: 2, Data: []byte("b")}},
+		{"index", &fragment{Type: messageTypeText, MessageID: 1, Index: 2, Count: 2, Data: []byte("b")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			partial := newPartialMessage(1, first)
+			if _, err := partial.add(first); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := partial.add(test.f); err == nil {
+				t.Fatal("mismatched fragment was accepted")
+			}
+			if partial.Received != 1 {
+				t.Fatalf("received count is %d, want 1", partial.Received)
+			}
+		})
+	}
+}
+
+func TestPartialMessageExpiry(t *testing.T) {
+	partial := newPartialMessage(1, &fragment{Type: messageTypeText, MessageID: 1, Count: 2})
+	if partial.isExpired(time.Now()) {
+		t.Fatal("new partial message is expired")
+	}
+	if !partial.isExpired(time.Now().Add(partialMessageTimeout + time.Minute)) {
+		t.Fatal("partial message did not expire")
+	}
+}
@@ -0,0 +1,156 @@
+// inbox.go - inbox management
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"context"
+	"fmt"
+)
+
+type deleteMessage struct {
+	ID           MessageID
+	ResponseChan chan error
+}
+
+// GetInbox returns a copy of the Client's inbox. The plaintexts are
+// copied too, as those of the inbox are wiped when messages are removed.
+func (c *Client) GetInbox() []*Message {
+	c.inboxMutex.Lock()
+	defer c.inboxMutex.Unlock()
+	inbox := make([]*Message, len(c.inbox))
+	for i, message := range c.inbox {
+		inbox[i] = message.copy()
+	}
+	return inbox
+}
+
+// getInbox returns a copy of the Client's inbox sharing
+// the plaintexts of its messages, for use by the worker.
+func (c *Client) getInbox() []*Message {
+	c.inboxMutex.Lock()
+	defer c.inboxMutex.Unlock()
+	inbox := make([]*Message, len(c.inbox))
+	for i, message := range c.inbox {
+		m := *message
+		inbox[i] = &m
+	}
+	return inbox
+}
+
+// GetContactInbox returns a copy of the messages in the
+// inbox received from the contact with the given nickname.
+func (c *Client) GetContactInbox(nickname string) []*Message {
+	inbox := []*Message{}
+	for _, message := range c.GetInbox() {
+		if message.Nickname == nickname {
+			inbox = append(inbox, message)
+		}
+	}
+	return inbox
+}
+
+// ReadMessage returns a copy of the message with the
+// given ID from the inbox and marks it as read.
+func (c *Client) ReadMessage(id MessageID) (*Message, error) {
+	c.inboxMutex.Lock()
+	defer c.inboxMutex.Unlock()
+	message := c.findMessage(id)
+	if message == nil {
+		return nil, fmt.Errorf("message %s not found", id)
+	}
+	message.Read = true
+	c.requestSave()
+	return message.copy(), nil
+}
+
+// MarkRead sets the read state of the message with the given ID
+// and has the worker write it to the statefile.
+func (c *Client) MarkRead(id MessageID, read bool) error {
+	c.inboxMutex.Lock()
+	defer c.inboxMutex.Unlock()
+	message := c.findMessage(id)
+	if message == nil {
+		return fmt.Errorf("message %s not found", id)
+	}
+	message.Read = read
+	c.requestSave()
+	return nil
+}
+
+// DeleteMessage removes the message with the given ID from the inbox.
+// Its plaintext is overwritten in memory and the statefile is rewritten
+// without it.
+func (c *Client) DeleteMessage(ctx context.Context, id MessageID) error {
+	responseChan := make(chan error, 1)
+	select {
+	case c.deleteMessageChan <- deleteMessage{
+		ID:           id,
+		ResponseChan: responseChan,
+	}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.HaltCh():
+		return errHalted
+	}
+	return c.waitResponse(ctx, responseChan)
+}
+
+// copy returns a copy of the message which doesn't share its plaintext.
+func (m *Message) copy() *Message {
+	message := *m
+	message.Plaintext = append([]byte(nil), m.Plaintext...)
+	return &message
+}
+
+func (c *Client) doDeleteMessage(id MessageID) error {
+	c.inboxMutex.Lock()
+	found := false
+	for i, message := range c.inbox {
+		if message.ID == id {
+			wipe(message.Plaintext)
+			c.inbox = append(c.inbox[:i], c.inbox[i+1:]...)
+			found = true
+			break
+		}
+	}
+	c.inboxMutex.Unlock()
+	if !found {
+		return fmt.Errorf("message %s not found", id)
+	}
+	c.save()
+	return nil
+}
+
+// findMessage must be called with the inbox mutex held.
+func (c *Client) findMessage(id MessageID) *Message {
+	for _, message := range c.inbox {
+		if message.ID == id {
+			return message
+		}
+	}
+	return nil
+}
+
+// assignMessageIDs gives an ID to the messages
+// received before messages had IDs.
+func assignMessageIDs(inbox []*Message) {
+	for _, message := range inbox {
+		if message.ID == 0 {
+			message.ID = newMessageID()
+		}
+	}
+}
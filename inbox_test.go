@@ -0,0 +1,65 @@
+// inbox_test.go - inbox tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWipeDoesNotAffectCopies(t *testing.T) {
+	c := &Client{
+		inboxMutex:        new(sync.Mutex),
+		sentMessagesMutex: new(sync.Mutex),
+		inbox: []*Message{{
+			ID:           1,
+			Nickname:     "alice",
+			Plaintext:    []byte("hello bob"),
+			ReceivedTime: time.Now(),
+		}},
+		sentMessages: []*SentMessage{{
+			ID:        2,
+			Nickname:  "alice",
+			Plaintext: []byte("hello alice"),
+			Status:    MessageSent,
+			SentTime:  time.Now(),
+		}},
+	}
+	inbox := c.GetInbox()
+	read, err := c.ReadMessage(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := c.GetSentMessages()
+	conversation := c.Conversation("alice")
+
+	wipe(c.inbox[0].Plaintext)
+	wipe(c.sentMessages[0].Plaintext)
+
+	if string(inbox[0].Plaintext) != "hello bob" || string(read.Plaintext) != "hello bob" {
+		t.Fatal("wiping the inbox changed a copy of a received message")
+	}
+	if string(sent[0].Plaintext) != "hello alice" {
+		t.Fatal("wiping the sent messages changed a copy of a sent message")
+	}
+	for _, m := range conversation {
+		if m.Plaintext[0] == 0 {
+			t.Fatal("wiping the messages changed the conversation")
+		}
+	}
+}
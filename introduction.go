@@ -0,0 +1,406 @@
+// introduction.go - introductions between contacts
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/katzenpost/channels"
+	"github.com/ugorji/go/codec"
+)
+
+// Introductions let a user who has completed key exchanges with two
+// contacts introduce them to each other. The introducer asks each of
+// them for a contact exchange over their existing ratchets and, once
+// both have accepted, forwards each one's contact exchange to the
+// other, which completes their key exchange without PANDA. The
+// introducer relays the key exchanges and so must be trusted not to
+// substitute its own.
+
+// introductionTimeout is how long an introduction waits
+// for the contacts to accept it before it is discarded.
+const introductionTimeout = 7 * 24 * time.Hour
+
+const (
+	// introRequest asks the contact to accept an
+	// introduction to another of the introducer's contacts.
+	introRequest uint8 = iota
+	// introReply accepts an introduction, it carries
+	// the contact exchange of the accepting contact.
+	introReply
+	// introForward carries the contact exchange of the
+	// other contact once both have accepted.
+	introForward
+)
+
+// introductionMessage is the body of a message
+// of type messageTypeIntroduction.
+type introductionMessage struct {
+	Kind            uint8
+	IntroID         MessageID
+	Nickname        string
+	ContactExchange []byte
+}
+
+// introduction is an introduction we made between two contacts, it is
+// kept until both contacts have replied with their contact exchange.
+type introduction struct {
+	ID         MessageID
+	ContactIDs [2]uint64
+	Exchanges  [2][]byte
+	Time       time.Time
+}
+
+// receivedIntroduction is an introduction made by one of our contacts.
+// ContactID is set once the introduction is accepted, it identifies the
+// pending contact which awaits the other contact's key exchange.
+type receivedIntroduction struct {
+	ID           MessageID
+	IntroducerID uint64
+	Introducer   string
+	Nickname     string
+	ContactID    uint64
+	ReceivedTime time.Time
+}
+
+// IntroductionInfo is a snapshot of an introduction made by a contact.
+type IntroductionInfo struct {
+	// ID identifies the introduction.
+	ID MessageID
+	// Introducer is the nickname of the contact who made the introduction.
+	Introducer string
+	// Nickname is the introducer's nickname for the introduced contact.
+	Nickname string
+	// Accepted is true once the introduction has been accepted.
+	Accepted bool
+	// ReceivedTime is the time the introduction was received.
+	ReceivedTime time.Time
+}
+
+type introduce struct {
+	Names        [2]string
+	ResponseChan chan error
+}
+
+type acceptIntroduction struct {
+	ID              MessageID
+	Name            string
+	SpoolReaderChan *channels.UnreliableSpoolReaderChannel
+	ResponseChan    chan error
+}
+
+// Introduce introduces the contacts with the given nicknames to each
+// other. Each of them is sent an introduction, which is reported by an
+// IntroductionReceivedEvent, and once both have accepted it they
+// become each other's contacts.
+func (c *Client) Introduce(ctx context.Context, nickname1, nickname2 string) error {
+	responseChan := make(chan error, 1)
+	select {
+	case c.introduceChan <- introduce{
+		Names:        [2]string{nickname1, nickname2},
+		ResponseChan: responseChan,
+	}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.HaltCh():
+		return errHalted
+	}
+	return c.waitResponse(ctx, responseChan)
+}
+
+// AcceptIntroduction accepts the introduction with the given ID and
+// adds the introduced contact with the given nickname, or with the
+// introducer's nickname for it if nickname is empty. The contact is
+// pending until the introducer forwards its key exchange.
+func (c *Client) AcceptIntroduction(ctx context.Context, id MessageID, nickname string) error {
+	spoolReaderChan, err := c.newContactSpoolContext(ctx)
+	if err != nil {
+		return err
+	}
+	responseChan := make(chan error, 1)
+	select {
+	case c.acceptIntroductionChan <- acceptIntroduction{
+		ID:              id,
+		Name:            nickname,
+		SpoolReaderChan: spoolReaderChan,
+		ResponseChan:    responseChan,
+	}:
+	case <-ctx.Done():
+		go c.purgeSpool(spoolReaderChan)
+		return ctx.Err()
+	case <-c.HaltCh():
+		go c.purgeSpool(spoolReaderChan)
+		return errHalted
+	}
+	return c.waitResponse(ctx, responseChan)
+}
+
+// GetIntroductions returns a snapshot of the
+// introductions made by our contacts.
+func (c *Client) GetIntroductions() []*IntroductionInfo {
+	responseChan := make(chan []*IntroductionInfo)
+	c.getIntroductionsChan <- responseChan
+	return <-responseChan
+}
+
+func (c *Client) introductionInfos() []*IntroductionInfo {
+	infos := []*IntroductionInfo{}
+	for _, intro := range c.receivedIntroductions {
+		infos = append(infos, &IntroductionInfo{
+			ID:           intro.ID,
+			Introducer:   intro.Introducer,
+			Nickname:     intro.Nickname,
+			Accepted:     intro.ContactID != 0,
+			ReceivedTime: intro.ReceivedTime,
+		})
+	}
+	return infos
+}
+
+func (c *Client) sendIntroductionMessage(contact *Contact, m *introductionMessage) error {
+	var payload []byte
+	err := codec.NewEncoderBytes(&payload, cborHandle).Encode(m)
+	if err != nil {
+		return err
+	}
+	return c.sendPayload(contact, messageTypeIntroduction, newMessageID(), payload)
+}
+
+func (c *Client) doIntroduce(nicknames [2]string) error {
+	if nicknames[0] == nicknames[1] {
+		return fmt.Errorf("cannot introduce %s to itself", nicknames[0])
+	}
+	contacts := [2]*Contact{}
+	for i, nickname := range nicknames {
+		contact, ok := c.contactNicknames[nickname]
+		if !ok {
+			return fmt.Errorf("contact %s not found", nickname)
+		}
+		if contact.isPending {
+			return fmt.Errorf("key exchange with %s has not completed", nickname)
+		}
+		if contact.peerVersion < envelopeVersion {
+			return fmt.Errorf("%s does not support introductions", nickname)
+		}
+		contacts[i] = contact
+	}
+	intro := &introduction{
+		ID:         newMessageID(),
+		ContactIDs: [2]uint64{contacts[0].id, contacts[1].id},
+		Time:       time.Now(),
+	}
+	for i, contact := range contacts {
+		err := c.sendIntroductionMessage(contact, &introductionMessage{
+			Kind:     introRequest,
+			IntroID:  intro.ID,
+			Nickname: nicknames[1-i],
+		})
+		if err != nil {
+			return err
+		}
+	}
+	c.introductions = append(c.introductions, intro)
+	c.log.Infof("Introduced %s to %s.", nicknames[0], nicknames[1])
+	c.save()
+	return nil
+}
+
+func (c *Client) doAcceptIntroduction(id MessageID, nickname string, spoolReaderChan *channels.UnreliableSpoolReaderChannel) error {
+	var intro *receivedIntroduction
+	for _, i := range c.receivedIntroductions {
+		if i.ID == id {
+			intro = i
+			break
+		}
+	}
+	if intro == nil {
+		go c.purgeSpool(spoolReaderChan)
+		return fmt.Errorf("introduction %s not found", id)
+	}
+	if intro.ContactID != 0 {
+		go c.purgeSpool(spoolReaderChan)
+		return fmt.Errorf("introduction %s has already been accepted", id)
+	}
+	if nickname == "" {
+		nickname = intro.Nickname
+	}
+	if _, ok := c.contactNicknames[nickname]; ok {
+		go c.purgeSpool(spoolReaderChan)
+		return fmt.Errorf("Contact with nickname %s, already exists.", nickname)
+	}
+	introducer, ok := c.contacts[intro.IntroducerID]
+	if !ok {
+		go c.purgeSpool(spoolReaderChan)
+		return fmt.Errorf("contact %s not found", intro.Introducer)
+	}
+	contact, err := NewContact(nickname, c.randID(), spoolReaderChan, c.session)
+	if err != nil {
+		go c.purgeSpool(spoolReaderChan)
+		return err
+	}
+	err = c.sendIntroductionMessage(introducer, &introductionMessage{
+		Kind:            introReply,
+		IntroID:         intro.ID,
+		ContactExchange: contact.keyExchange,
+	})
+	if err != nil {
+		go c.purgeSpool(spoolReaderChan)
+		return err
+	}
+	contact.keyExchange = nil
+	c.contacts[contact.id] = contact
+	c.contactNicknames[contact.nickname] = contact
+	intro.ContactID = contact.id
+	c.log.Infof("Accepted introduction to %s from %s.", nickname, intro.Introducer)
+	c.save()
+	return nil
+}
+
+// processIntroductionMessage handles an introduction message
+// received from the contact.
+func (c *Client) processIntroductionMessage(contact *Contact, body []byte) {
+	m := new(introductionMessage)
+	err := codec.NewDecoderBytes(body, cborHandle).Decode(m)
+	if err != nil {
+		c.log.Errorf("failure to decode introduction message from %s: %s", contact.nickname, err)
+		return
+	}
+	switch m.Kind {
+	case introRequest:
+		c.processIntroductionRequest(contact, m)
+	case introReply:
+		c.processIntroductionReply(contact, m)
+	case introForward:
+		c.processIntroductionForward(contact, m)
+	default:
+		c.log.Errorf("received introduction message of unknown kind %d from %s", m.Kind, contact.nickname)
+	}
+}
+
+func (c *Client) processIntroductionRequest(contact *Contact, m *introductionMessage) {
+	for _, intro := range c.receivedIntroductions {
+		if intro.ID == m.IntroID && intro.IntroducerID == contact.id {
+			return
+		}
+	}
+	intro := &receivedIntroduction{
+		ID:           m.IntroID,
+		IntroducerID: contact.id,
+		Introducer:   contact.nickname,
+		Nickname:     m.Nickname,
+		ReceivedTime: time.Now(),
+	}
+	c.receivedIntroductions = append(c.receivedIntroductions, intro)
+	c.log.Infof("%s introduced %s.", contact.nickname, m.Nickname)
+	c.emitEvent(&IntroductionReceivedEvent{
+		Introducer: contact.nickname,
+		ID:         intro.ID,
+		Nickname:   intro.Nickname,
+	})
+}
+
+// processIntroductionReply records the contact exchange of a contact
+// who accepted our introduction and forwards the contact exchanges
+// once both contacts have accepted.
+func (c *Client) processIntroductionReply(contact *Contact, m *introductionMessage) {
+	for i, intro := range c.introductions {
+		if intro.ID != m.IntroID {
+			continue
+		}
+		for j, id := range intro.ContactIDs {
+			if id == contact.id {
+				intro.Exchanges[j] = m.ContactExchange
+			}
+		}
+		if intro.Exchanges[0] == nil || intro.Exchanges[1] == nil {
+			return
+		}
+		c.introductions = append(c.introductions[:i], c.introductions[i+1:]...)
+		for j, id := range intro.ContactIDs {
+			recipient, ok := c.contacts[id]
+			if !ok {
+				c.log.Errorf("failure to complete introduction %s: contact was removed", intro.ID)
+				continue
+			}
+			err := c.sendIntroductionMessage(recipient, &introductionMessage{
+				Kind:            introForward,
+				IntroID:         intro.ID,
+				ContactExchange: intro.Exchanges[1-j],
+			})
+			if err != nil {
+				c.log.Errorf("failure to complete introduction of %s: %s", recipient.nickname, err)
+			}
+		}
+		return
+	}
+}
+
+// processIntroductionForward completes the key exchange with the
+// contact created when we accepted the introduction.
+func (c *Client) processIntroductionForward(contact *Contact, m *introductionMessage) {
+	for i, intro := range c.receivedIntroductions {
+		if intro.ID != m.IntroID || intro.IntroducerID != contact.id || intro.ContactID == 0 {
+			continue
+		}
+		c.receivedIntroductions = append(c.receivedIntroductions[:i], c.receivedIntroductions[i+1:]...)
+		introduced, ok := c.contacts[intro.ContactID]
+		if !ok || !introduced.isPending {
+			return
+		}
+		c.log.Infof("Completing key exchange with %s introduced by %s.", introduced.nickname, contact.nickname)
+		c.completeKeyExchange(introduced, m.ContactExchange)
+		return
+	}
+}
+
+// expireIntroductions discards the introductions which were not
+// accepted in time and returns true if any were discarded. The key
+// exchange of a contact whose introduction expired fails.
+func (c *Client) expireIntroductions() bool {
+	now := time.Now()
+	intros := []*introduction{}
+	for _, intro := range c.introductions {
+		if now.Sub(intro.Time) > introductionTimeout {
+			c.log.Warningf("discarding introduction %s, it was not accepted in time", intro.ID)
+			continue
+		}
+		intros = append(intros, intro)
+	}
+	received := []*receivedIntroduction{}
+	for _, intro := range c.receivedIntroductions {
+		if now.Sub(intro.ReceivedTime) <= introductionTimeout {
+			received = append(received, intro)
+			continue
+		}
+		c.log.Warningf("discarding introduction %s from %s", intro.ID, intro.Introducer)
+		contact, ok := c.contacts[intro.ContactID]
+		if ok && contact.isPending {
+			err := fmt.Errorf("introduction by %s expired", intro.Introducer)
+			contact.pandaResult = err.Error()
+			c.emitEvent(&KeyExchangeFailedEvent{
+				Nickname: contact.nickname,
+				Err:      err,
+			})
+		}
+	}
+	expired := len(intros) != len(c.introductions) || len(received) != len(c.receivedIntroductions)
+	c.introductions = intros
+	c.receivedIntroductions = received
+	return expired
+}
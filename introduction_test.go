@@ -0,0 +1,79 @@
+// introduction_test.go - introduction tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"testing"
+)
+
+func TestIntroduction(t *testing.T) {
+	spools := newFakeSpoolService()
+	alice := newTestClient(t, "alice", spools)
+	bob := newTestClient(t, "bob", spools)
+	carol := newTestClient(t, "carol", spools)
+	pairTestClients(t, alice, bob)
+	pairTestClients(t, alice, carol)
+
+	if err := alice.doIntroduce([2]string{"bob", "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	settle(alice)
+	for _, c := range []*Client{bob, carol} {
+		poll(c)
+		if len(c.receivedIntroductions) != 1 {
+			t.Fatalf("%s received %d introductions", c.user, len(c.receivedIntroductions))
+		}
+		spoolReaderChan, err := c.newContactSpool()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.doAcceptIntroduction(c.receivedIntroductions[0].ID, "", spoolReaderChan); err != nil {
+			t.Fatal(err)
+		}
+		settle(c)
+	}
+	exchangeMessages(alice, bob, carol)
+
+	if len(alice.introductions) != 0 {
+		t.Fatal("alice didn't forward the contact exchanges")
+	}
+	for _, c := range []*Client{bob, carol} {
+		if len(c.receivedIntroductions) != 0 {
+			t.Fatalf("%s didn't complete the introduction", c.user)
+		}
+	}
+	bobsCarol, ok := bob.contactNicknames["carol"]
+	if !ok || bobsCarol.isPending {
+		t.Fatal("bob's key exchange with carol didn't complete")
+	}
+	carolsBob, ok := carol.contactNicknames["bob"]
+	if !ok || carolsBob.isPending {
+		t.Fatal("carol's key exchange with bob didn't complete")
+	}
+
+	sendTestMessage(t, bob, "carol", "hello carol")
+	settle(bob)
+	sendTestMessage(t, carol, "bob", "hello bob")
+	settle(carol)
+	exchangeMessages(bob, carol)
+	if text := inboxText(carol); len(text) != 1 || text[0] != "hello carol" {
+		t.Fatalf("got carol's inbox %q", text)
+	}
+	if text := inboxText(bob); len(text) != 1 || text[0] != "hello bob" {
+		t.Fatalf("got bob's inbox %q", text)
+	}
+}
@@ -0,0 +1,217 @@
+// outbox.go - persistent outbox of undelivered spool writes
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"context"
+	"time"
+
+	"github.com/katzenpost/channels"
+)
+
+const (
+	// outboxRetryInterval is how often the worker checks
+	// the outbox for entries which are due to be retried.
+	outboxRetryInterval = 30 * time.Second
+
+	// outboxInitialBackoff and outboxMaxBackoff bound the delay
+	// between retries of a failed spool write.
+	outboxInitialBackoff = 30 * time.Second
+	outboxMaxBackoff     = time.Hour
+
+	// maxSpoolWriteJobs is the maximum number of
+	// spool writes in flight at the same time.
+	maxSpoolWriteJobs = 4
+)
+
+// outboxEntry is a ratchet encrypted message fragment which
+// has not yet been successfully written to the contact's spool.
+// Once the ratchet has encrypted a fragment the ciphertext can't
+// be recreated, so it is kept in the statefile until the spool
+// write is confirmed.
+type outboxEntry struct {
+	ContactID   uint64
+	MessageID   MessageID
+	Ciphertext  []byte
+	Attempts    uint32
+	NextAttempt time.Time
+}
+
+// backoff schedules the next attempt of a failed spool write.
+func (e *outboxEntry) backoff(now time.Time) {
+	e.Attempts++
+	delay := outboxInitialBackoff
+	for i := uint32(1); i < e.Attempts && delay < outboxMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > outboxMaxBackoff {
+		delay = outboxMaxBackoff
+	}
+	e.NextAttempt = now.Add(delay)
+}
+
+// spoolWriteResult is the outcome of a spool write job.
+type spoolWriteResult struct {
+	Entry *outboxEntry
+	Err   error
+}
+
+// flushOutbox starts spool write jobs for the outbox entries which
+// are due. The jobs perform the mixnet round trips in their own
+// goroutines and post their results back to the worker. Only the
+// oldest entry of each contact is written at a time so that the
+// contact reads the ciphertexts in the order the ratchet encrypted
+// them, later entries wait behind one which is backing off.
+func (c *Client) flushOutbox() {
+	now := time.Now()
+	due := []*outboxEntry{}
+	blocked := make(map[uint64]bool)
+	for _, e := range c.outbox {
+		if len(c.outboxInFlight)+len(due) >= maxSpoolWriteJobs {
+			break
+		}
+		if blocked[e.ContactID] {
+			continue
+		}
+		blocked[e.ContactID] = true
+		if c.outboxInFlight[e] || now.Before(e.NextAttempt) {
+			continue
+		}
+		due = append(due, e)
+	}
+	for _, e := range due {
+		contact, ok := c.contacts[e.ContactID]
+		if !ok {
+			c.removeOutboxEntry(e)
+			continue
+		}
+		c.outboxInFlight[e] = true
+		go c.writeSpool(contact.spoolWriterChan, e)
+	}
+}
+
+// writeSpool is run in its own goroutine by flushOutbox.
+func (c *Client) writeSpool(writer *channels.UnreliableSpoolWriterChannel, entry *outboxEntry) {
+	err := writer.Write(c.spoolService, entry.Ciphertext)
+	select {
+	case c.spoolWriteResultChan <- spoolWriteResult{
+		Entry: entry,
+		Err:   err,
+	}:
+	case <-c.HaltCh():
+	}
+}
+
+// processSpoolWriteResult removes the entry from the outbox if the
+// spool write succeeded, otherwise the write is rescheduled.
+func (c *Client) processSpoolWriteResult(result spoolWriteResult) {
+	entry := result.Entry
+	delete(c.outboxInFlight, entry)
+	// The finished job frees a slot for the next due entry.
+	defer c.flushOutbox()
+	c.updateConnectionStatus(result.Err)
+	contact, ok := c.contacts[entry.ContactID]
+	if !ok || !c.inOutbox(entry) {
+		// The contact was removed or its key exchange
+		// restarted while the write was in flight.
+		return
+	}
+	if result.Err != nil {
+		entry.backoff(time.Now())
+		c.log.Errorf("spool write attempt %d for message %s failed: %s", entry.Attempts, entry.MessageID, result.Err)
+		if c.isSentMessage(entry.MessageID) {
+			c.emitEvent(&MessageSentEvent{
+				Nickname:  contact.nickname,
+				MessageID: entry.MessageID,
+				Err:       result.Err,
+			})
+		}
+		return
+	}
+	c.removeOutboxEntry(entry)
+	for _, e := range c.outbox {
+		if e.MessageID == entry.MessageID && e.ContactID == entry.ContactID {
+			return
+		}
+	}
+	c.fileChunkWritten(entry.MessageID)
+	if !c.setMessageStatus(entry.MessageID, MessageSent) {
+		return
+	}
+	c.log.Infof("Sent message %s to %s.", entry.MessageID, contact.nickname)
+	c.emitEvent(&MessageSentEvent{
+		Nickname:  contact.nickname,
+		MessageID: entry.MessageID,
+	})
+}
+
+// Drain waits until every message queued so far has been written to
+// the contacts' spools, or until the context is done. Spool writes which
+// keep failing are retried with a backoff, so a deadline should be set.
+func (c *Client) Drain(ctx context.Context) error {
+	responseChan := make(chan error, 1)
+	select {
+	case c.drainChan <- responseChan:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.HaltCh():
+		return errHalted
+	}
+	return c.waitResponse(ctx, responseChan)
+}
+
+// notifyDrained answers the pending Drain calls once
+// the outbox is empty and no spool write is in flight.
+func (c *Client) notifyDrained() {
+	if len(c.outbox) > 0 || len(c.outboxInFlight) > 0 {
+		return
+	}
+	for _, responseChan := range c.drainWaiters {
+		responseChan <- nil
+	}
+	c.drainWaiters = nil
+}
+
+func (c *Client) inOutbox(entry *outboxEntry) bool {
+	for _, e := range c.outbox {
+		if e == entry {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) removeOutboxEntry(entry *outboxEntry) {
+	for i, e := range c.outbox {
+		if e == entry {
+			c.outbox = append(c.outbox[:i], c.outbox[i+1:]...)
+			return
+		}
+	}
+}
+
+// removeContactOutbox discards the outbox entries destined
+// to the contact with the given ID.
+func (c *Client) removeContactOutbox(contactID uint64) {
+	outbox := []*outboxEntry{}
+	for _, e := range c.outbox {
+		if e.ContactID != contactID {
+			outbox = append(outbox, e)
+		}
+	}
+	c.outbox = outbox
+}
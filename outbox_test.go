@@ -0,0 +1,165 @@
+// outbox_test.go - outbox tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	now := time.Now()
+	e := new(outboxEntry)
+	want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute}
+	for _, delay := range want {
+		e.backoff(now)
+		if got := e.NextAttempt.Sub(now); got != delay {
+			t.Fatalf("attempt %d: got delay %s, want %s", e.Attempts, got, delay)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		e.backoff(now)
+	}
+	if got := e.NextAttempt.Sub(now); got != outboxMaxBackoff {
+		t.Fatalf("got delay %s, want %s", got, outboxMaxBackoff)
+	}
+}
+
+func TestOutboxRetry(t *testing.T) {
+	spools := newFakeSpoolService()
+	alice := newTestClient(t, "alice", spools)
+	bob := newTestClient(t, "bob", spools)
+	pairTestClients(t, alice, bob)
+
+	spools.failWrites = 2
+	id := sendTestMessage(t, alice, "bob", "hello bob")
+	for attempt := uint32(1); attempt <= 2; attempt++ {
+		settle(alice)
+		if len(alice.outbox) != 1 {
+			t.Fatal("failed write was removed from the outbox")
+		}
+		e := alice.outbox[0]
+		if e.Attempts != attempt || !e.NextAttempt.After(time.Now()) {
+			t.Fatalf("failed write was not backed off: %d attempts, next at %s", e.Attempts, e.NextAttempt)
+		}
+		waitEvent(t, alice, func(e Event) bool {
+			event, ok := e.(*MessageSentEvent)
+			return ok && event.MessageID == id && event.Err == errTestMixnet
+		})
+		// The entry isn't retried before it is due.
+		alice.flushOutbox()
+		if len(alice.outboxInFlight) != 0 {
+			t.Fatal("write was retried before it was due")
+		}
+		e.NextAttempt = time.Now()
+		alice.flushOutbox()
+	}
+	settle(alice)
+	if len(alice.outbox) != 0 {
+		t.Fatal("written message was left in the outbox")
+	}
+	waitEvent(t, alice, func(e Event) bool {
+		event, ok := e.(*MessageSentEvent)
+		return ok && event.MessageID == id && event.Err == nil
+	})
+	if status, _ := alice.GetMessageStatus(id); status != MessageSent {
+		t.Fatalf("got message status %s, want %s", status, MessageSent)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	spools := newFakeSpoolService()
+	alice := newTestClient(t, "alice", spools)
+	bob := newTestClient(t, "bob", spools)
+	pairTestClients(t, alice, bob)
+
+	spools.writeBlock = make(chan struct{})
+	sendTestMessage(t, alice, "bob", "hello bob")
+	alice.Go(alice.worker)
+	defer alice.Halt()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := alice.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- alice.Drain(context.Background())
+	}()
+	select {
+	case err := <-drained:
+		t.Fatalf("Drain returned %v before the message was written", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(spools.writeBlock)
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Drain didn't return once the message was written")
+	}
+	if len(spools.spool(bob.contactNicknames["alice"].spoolReaderChan.SpoolID)) != 1 {
+		t.Fatal("message was not written to the spool")
+	}
+}
+
+func TestOutboxHeadOfLine(t *testing.T) {
+	spools := newFakeSpoolService()
+	alice := newTestClient(t, "alice", spools)
+	bob := newTestClient(t, "bob", spools)
+	pairTestClients(t, alice, bob)
+
+	spools.failWrites = 1
+	sendTestMessage(t, alice, "bob", "first")
+	sendTestMessage(t, alice, "bob", "second")
+	sendTestMessage(t, alice, "bob", "third")
+	settle(alice)
+	if len(alice.outbox) != 3 {
+		t.Fatalf("got %d outbox entries, want 3", len(alice.outbox))
+	}
+	if alice.outbox[0].Attempts != 1 {
+		t.Fatalf("first entry was attempted %d times", alice.outbox[0].Attempts)
+	}
+	for _, e := range alice.outbox[1:] {
+		if e.Attempts != 0 {
+			t.Fatal("entry was written while an older one was backing off")
+		}
+	}
+	if spools.writes != 0 {
+		t.Fatalf("%d messages were written behind the failed one", spools.writes)
+	}
+
+	alice.outbox[0].NextAttempt = time.Time{}
+	alice.flushOutbox()
+	settle(alice)
+	if len(alice.outbox) != 0 {
+		t.Fatalf("%d outbox entries left", len(alice.outbox))
+	}
+	poll(bob)
+	text := inboxText(bob)
+	if len(text) != 3 || text[0] != "first" || text[1] != "second" || text[2] != "third" {
+		t.Fatalf("got inbox %q", text)
+	}
+	if len(bob.quarantine) != 0 {
+		t.Fatalf("%d messages were quarantined", len(bob.quarantine))
+	}
+}
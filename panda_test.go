@@ -0,0 +1,265 @@
+// panda_test.go - PANDA key exchange resumption tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/katzenpost/channels"
+	pclient "github.com/katzenpost/panda/client"
+	panda "github.com/katzenpost/panda/crypto"
+	panda_proto "github.com/katzenpost/panda/crypto/proto"
+)
+
+// fakeMeetingPlace pairs the messages posted under the same meeting ID
+// and replies to each party with the other party's message. A party
+// which posts its message again, as a resumed exchange does, is given
+// the same reply. A different message posted under a meeting ID which
+// already has two is a replay which didn't regenerate the message.
+type fakeMeetingPlace struct {
+	sync.Mutex
+
+	messages map[string][][]byte
+	replayed bool
+}
+
+func newFakeMeetingPlace() *fakeMeetingPlace {
+	return &fakeMeetingPlace{
+		messages: make(map[string][][]byte),
+	}
+}
+
+func (m *fakeMeetingPlace) Padding() int {
+	return 2048
+}
+
+func (m *fakeMeetingPlace) post(id, message []byte) {
+	m.Lock()
+	defer m.Unlock()
+	messages := m.messages[string(id)]
+	for _, posted := range messages {
+		if bytes.Equal(posted, message) {
+			return
+		}
+	}
+	if len(messages) == 2 {
+		m.replayed = true
+		return
+	}
+	m.messages[string(id)] = append(messages, append([]byte{}, message...))
+}
+
+func (m *fakeMeetingPlace) reply(id, message []byte) []byte {
+	m.Lock()
+	defer m.Unlock()
+	for _, posted := range m.messages[string(id)] {
+		if !bytes.Equal(posted, message) {
+			return posted
+		}
+	}
+	return nil
+}
+
+func (m *fakeMeetingPlace) Exchange(id, message []byte, shutdown chan struct{}) ([]byte, error) {
+	m.post(id, message)
+	for {
+		if reply := m.reply(id, message); reply != nil {
+			return reply, nil
+		}
+		select {
+		case <-shutdown:
+			return nil, errors.New(panda.ShutdownErrMessage)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// testPandaExchange is the outcome of running a PANDA key exchange.
+type testPandaExchange struct {
+	states []*panda_proto.KeyExchange
+	result []byte
+	err    error
+}
+
+// runTestPanda runs the key exchange to completion and returns the
+// states it saved along the way, starting with its initial state.
+func runTestPanda(t *testing.T, random io.Reader, place panda.MeetingPlace, sharedSecret, kxBytes []byte) chan testPandaExchange {
+	pandaChan := make(chan panda.PandaUpdate)
+	kx, err := panda.NewKeyExchange(random, testLog, place, sharedSecret, kxBytes, 1, pandaChan, make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan testPandaExchange, 1)
+	go func() {
+		exchange := testPandaExchange{}
+		unmarshal := func(serialised []byte) {
+			state := new(panda_proto.KeyExchange)
+			if err := proto.Unmarshal(serialised, state); err != nil {
+				exchange.err = err
+			}
+			exchange.states = append(exchange.states, state)
+		}
+		unmarshal(kx.Marshal())
+		go kx.Run()
+		for update := range pandaChan {
+			if update.Serialised != nil {
+				unmarshal(update.Serialised)
+				continue
+			}
+			if exchange.err == nil {
+				exchange.err = update.Err
+			}
+			exchange.result = update.Result
+			done <- exchange
+			return
+		}
+	}()
+	return done
+}
+
+func waitTestPanda(t *testing.T, done chan testPandaExchange) testPandaExchange {
+	select {
+	case exchange := <-done:
+		if exchange.err != nil {
+			t.Fatal(exchange.err)
+		}
+		return exchange
+	case <-time.After(time.Minute):
+		t.Fatal("timed out waiting for the PANDA key exchange")
+	}
+	return testPandaExchange{}
+}
+
+func testContactExchange(t *testing.T) []byte {
+	_, kx := newTestKeyExchange(t)
+	writer := &channels.UnreliableSpoolWriterChannel{
+		SpoolID:       []byte("spool"),
+		SpoolReceiver: "spool",
+		SpoolProvider: "provider",
+	}
+	exchange, err := NewContactExchangeBytes(writer, kx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exchange
+}
+
+func TestPandaResume(t *testing.T) {
+	place := newFakeMeetingPlace()
+	sharedSecret := []byte("correct horse battery staple")
+	aliceKx := testContactExchange(t)
+	bobKx := testContactExchange(t)
+
+	random := func() io.Reader {
+		random, err := newPandaRandom()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return random
+	}
+	bobDone := runTestPanda(t, random(), place, sharedSecret, bobKx)
+	alice := waitTestPanda(t, runTestPanda(t, random(), place, sharedSecret, aliceKx))
+	waitTestPanda(t, bobDone)
+	if !bytes.Equal(alice.result, bobKx) {
+		t.Fatal("alice received the wrong key exchange")
+	}
+	if len(alice.states) != 3 {
+		t.Fatalf("got %d saved states, want 3", len(alice.states))
+	}
+
+	for _, saved := range alice.states {
+		t.Run(saved.GetStatus().String(), func(t *testing.T) {
+			replay, err := pandaReplayBytes(saved)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resumeRandom, err := pandaResumeRandom(saved)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved.GetStatus() == panda_proto.KeyExchange_INIT {
+				if len(replay) != 0 {
+					t.Fatal("nothing is replayed before the first message was derived")
+				}
+				// Nothing was sent, so the resumed exchange
+				// meets a peer which has not met alice yet.
+				place := newFakeMeetingPlace()
+				bobDone := runTestPanda(t, random(), place, sharedSecret, bobKx)
+				resumed := waitTestPanda(t, runTestPanda(t, resumeRandom, place, saved.SharedSecret, saved.KeyExchangeBytes))
+				waitTestPanda(t, bobDone)
+				if !bytes.Equal(resumed.result, bobKx) {
+					t.Fatal("resumed exchange received the wrong key exchange")
+				}
+				return
+			}
+			resumed := waitTestPanda(t, runTestPanda(t, resumeRandom, place, saved.SharedSecret, saved.KeyExchangeBytes))
+			if !bytes.Equal(resumed.result, bobKx) {
+				t.Fatal("resumed exchange received the wrong key exchange")
+			}
+			for i, state := range resumed.states[1:] {
+				original := alice.states[i+1]
+				if !bytes.Equal(state.DhPrivate, original.DhPrivate) {
+					t.Fatalf("%s DH key differs", state.GetStatus())
+				}
+				if !bytes.Equal(state.Message1, original.Message1) {
+					t.Fatalf("%s message 1 differs", state.GetStatus())
+				}
+				if !bytes.Equal(state.Message2, original.Message2) {
+					t.Fatalf("%s message 2 differs", state.GetStatus())
+				}
+			}
+			if place.replayed {
+				t.Fatal("resumed exchange posted a different message")
+			}
+		})
+	}
+}
+
+func TestRestartKeyExchangeRejected(t *testing.T) {
+	tests := []struct {
+		name         string
+		contact      *Contact
+		sharedSecret []byte
+	}{
+		{"unknown contact", nil, []byte("secret")},
+		{"in progress", &Contact{isPending: true}, []byte("secret")},
+		{"completed", &Contact{}, []byte("secret")},
+		{"contended without a new secret", &Contact{isPending: true, pandaResult: pclient.TagContendedError.Error(), sharedSecret: []byte("secret")}, nil},
+		{"no shared secret", &Contact{isPending: true, pandaResult: "failed"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestClient(t, "alice", newFakeSpoolService())
+			if test.contact != nil {
+				test.contact.nickname = "bob"
+				c.contactNicknames["bob"] = test.contact
+			}
+			if err := c.doRestartKeyExchange("bob", test.sharedSecret); err == nil {
+				t.Fatal("key exchange was restarted")
+			}
+			if test.contact != nil && test.contact.ratchet != nil {
+				t.Fatal("rejected restart reset the key exchange")
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// quarantine.go - undecryptable spool messages kept for later decryption
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"time"
+)
+
+const (
+	// defaultQuarantineTimeout is how long we keep a message which
+	// none of our contacts' ratchets could decrypt.
+	defaultQuarantineTimeout = 7 * 24 * time.Hour
+
+	// maxQuarantinedMessages is the maximum number of quarantined
+	// messages, the oldest are discarded to make room for new ones.
+	maxQuarantinedMessages = 256
+)
+
+// quarantinedMessage is a ciphertext read from the remote spool which
+// none of our contacts' ratchets could decrypt. This happens when a
+// contact completes the key exchange and writes to our spool before
+// we have processed the key exchange result, so the ciphertext is
+// kept and retried once a key exchange completes.
+type quarantinedMessage struct {
+	// ContactID is the ID of the contact whose spool the message
+	// was read from, or sharedSpoolID.
+	ContactID    uint64
+	Ciphertext   []byte
+	ReceivedTime time.Time
+}
+
+// quarantineMessage keeps the ciphertext for a later decryption attempt.
+func (c *Client) quarantineMessage(contactID uint64, ciphertext []byte) {
+	if len(c.quarantine) >= maxQuarantinedMessages {
+		c.log.Warningf("quarantine is full, discarding oldest message received at %s", c.quarantine[0].ReceivedTime)
+		c.quarantine = c.quarantine[1:]
+	}
+	c.quarantine = append(c.quarantine, &quarantinedMessage{
+		ContactID:    contactID,
+		Ciphertext:   ciphertext,
+		ReceivedTime: time.Now(),
+	})
+	c.log.Debugf("quarantined undecryptable message, %d messages in quarantine", len(c.quarantine))
+}
+
+// retryQuarantine attempts to decrypt the quarantined messages in the
+// order they were received and returns true if any were decrypted.
+func (c *Client) retryQuarantine() bool {
+	return c.retryQuarantined(func(m *quarantinedMessage) bool {
+		return true
+	})
+}
+
+// retryContactQuarantine attempts to decrypt the quarantined messages
+// read from the spool of the contact with the given ID, or from the
+// shared spool. A message which arrived too far ahead of the ones
+// before it for the ratchet to decrypt can be decrypted once they
+// have been.
+func (c *Client) retryContactQuarantine(contactID uint64) bool {
+	return c.retryQuarantined(func(m *quarantinedMessage) bool {
+		return m.ContactID == contactID
+	})
+}
+
+// retryQuarantined attempts to decrypt the matching quarantined
+// messages until none of those left can be decrypted, and returns
+// true if any were decrypted.
+func (c *Client) retryQuarantined(match func(*quarantinedMessage) bool) bool {
+	decrypted := 0
+	for {
+		quarantine := []*quarantinedMessage{}
+		for _, m := range c.quarantine {
+			if _, ok := c.contacts[m.ContactID]; !ok && m.ContactID != sharedSpoolID {
+				// The contact was removed.
+				continue
+			}
+			if !match(m) || !c.tryDecryptMessage(m.ContactID, m.Ciphertext) {
+				quarantine = append(quarantine, m)
+			}
+		}
+		progress := len(c.quarantine) - len(quarantine)
+		c.quarantine = quarantine
+		if progress == 0 {
+			break
+		}
+		decrypted += progress
+	}
+	if decrypted > 0 {
+		c.log.Debugf("decrypted %d quarantined messages", decrypted)
+	}
+	return decrypted > 0
+}
+
+// expireQuarantine discards the quarantined messages older than
+// the quarantine timeout and returns true if any were discarded.
+func (c *Client) expireQuarantine() bool {
+	now := time.Now()
+	quarantine := []*quarantinedMessage{}
+	for _, m := range c.quarantine {
+		if now.Sub(m.ReceivedTime) > c.quarantineTimeout {
+			c.log.Warningf("discarding undecryptable message received at %s", m.ReceivedTime)
+			continue
+		}
+		quarantine = append(quarantine, m)
+	}
+	expired := len(quarantine) != len(c.quarantine)
+	c.quarantine = quarantine
+	return expired
+}
+
+// SetQuarantineTimeout sets how long messages which could not be
+// decrypted are kept for a later attempt. It must be called before
+// Start.
+func (c *Client) SetQuarantineTimeout(timeout time.Duration) {
+	c.quarantineTimeout = timeout
+}
@@ -0,0 +1,90 @@
+// quarantine_test.go - quarantine tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestQuarantineOutOfOrder(t *testing.T) {
+	spools := newFakeSpoolService()
+	alice := newTestClient(t, "alice", spools)
+	bob := newTestClient(t, "bob", spools)
+	pairTestClients(t, alice, bob)
+
+	// The last message is further ahead of the first
+	// than the ratchet tolerates missing messages.
+	want := []string{}
+	for i := 0; i < 10; i++ {
+		message := fmt.Sprintf("message %d", i)
+		sendTestMessage(t, alice, "bob", message)
+		want = append(want, message)
+	}
+	settle(alice)
+	spools.moveLastToFront(alice.contactNicknames["bob"].spoolWriterChan.SpoolID)
+	poll(bob)
+
+	text := inboxText(bob)
+	sort.Strings(text)
+	if fmt.Sprint(text) != fmt.Sprint(want) {
+		t.Fatalf("got inbox %q", text)
+	}
+	if len(bob.quarantine) != 0 {
+		t.Fatalf("%d messages left in quarantine", len(bob.quarantine))
+	}
+}
+
+func TestDuplicateCiphertextDropped(t *testing.T) {
+	spools := newFakeSpoolService()
+	alice := newTestClient(t, "alice", spools)
+	bob := newTestClient(t, "bob", spools)
+	pairTestClients(t, alice, bob)
+
+	sendTestMessage(t, alice, "bob", "hello bob")
+	settle(alice)
+	spools.duplicateLast(alice.contactNicknames["bob"].spoolWriterChan.SpoolID)
+	poll(bob)
+	if text := inboxText(bob); len(text) != 1 || text[0] != "hello bob" {
+		t.Fatalf("got inbox %q", text)
+	}
+	if len(bob.quarantine) != 0 {
+		t.Fatal("duplicate message was quarantined")
+	}
+
+	// The hashes of the decrypted ciphertexts survive a restart.
+	contact := bob.contactNicknames["alice"]
+	serialized, err := contact.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := new(Contact)
+	if err := loaded.UnmarshalBinary(serialized); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.decrypted) != len(contact.decrypted) {
+		t.Fatal("decrypted ciphertext hashes were not saved")
+	}
+	spools.duplicateLast(alice.contactNicknames["bob"].spoolWriterChan.SpoolID)
+	bob.contacts[contact.id] = loaded
+	bob.contactNicknames["alice"] = loaded
+	poll(bob)
+	if len(bob.GetInbox()) != 1 || len(bob.quarantine) != 0 {
+		t.Fatal("duplicate message was not dropped after a restart")
+	}
+}
@@ -0,0 +1,137 @@
+// recovery.go - recovery of lost remote spools
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"bytes"
+
+	"github.com/katzenpost/channels"
+)
+
+// spoolRecoveryResult is the outcome of a spool recovery job.
+type spoolRecoveryResult struct {
+	ContactID       uint64
+	SpoolReaderChan *channels.UnreliableSpoolReaderChannel
+	Err             error
+}
+
+// processLostSpool handles a spool which no longer exists on the
+// Provider. Old spools are forgotten, whereas contacts whose current
+// spool was lost are marked as such and their spool is replaced if
+// spool recovery is enabled. It returns true if the state changed.
+func (c *Client) processLostSpool(contactID uint64, spoolID []byte, err error) bool {
+	if c.findSpoolReader(contactID, spoolID) == nil {
+		return false
+	}
+	if contactID == sharedSpoolID {
+		c.log.Errorf("shared spool lost: %s", err)
+		for _, contact := range c.contacts {
+			if contact.leavingSharedSpool {
+				contact.leavingSharedSpool = false
+				continue
+			}
+			if contact.readsSharedSpool() {
+				c.spoolLost(contact, err)
+			}
+		}
+		if c.sharedSpoolUnused() {
+			c.spoolReaderChan = nil
+		}
+		return true
+	}
+	contact := c.contacts[contactID]
+	if contact.spoolReaderChan == nil || !bytes.Equal(contact.spoolReaderChan.SpoolID, spoolID) {
+		c.log.Warningf("old spool of %s lost: %s", contact.nickname, err)
+		for i, reader := range contact.oldSpoolReaderChans {
+			if bytes.Equal(reader.SpoolID, spoolID) {
+				contact.oldSpoolReaderChans = append(contact.oldSpoolReaderChans[:i], contact.oldSpoolReaderChans[i+1:]...)
+				break
+			}
+		}
+		return true
+	}
+	c.log.Errorf("spool of %s lost: %s", contact.nickname, err)
+	c.spoolLost(contact, err)
+	return true
+}
+
+// spoolLost marks the contact's spool as lost
+// and starts the recovery of the spool.
+func (c *Client) spoolLost(contact *Contact, err error) {
+	if !contact.spoolLost {
+		contact.spoolLost = true
+		c.emitEvent(&SpoolLostEvent{
+			Nickname: contact.nickname,
+			Err:      err,
+		})
+	}
+	if !c.spoolRecovery {
+		c.log.Warningf("spool recovery is disabled, rotate the spool of %s to recover", contact.nickname)
+		return
+	}
+	if contact.isPending {
+		// The key exchange must be restarted to give
+		// the contact a spool to write to.
+		c.log.Warningf("can't replace the spool of %s before the key exchange completes", contact.nickname)
+		return
+	}
+	if c.spoolRecoveries[contact.id] {
+		return
+	}
+	c.spoolRecoveries[contact.id] = true
+	go c.recreateSpool(contact.id)
+}
+
+// recreateSpool is run in its own goroutine by spoolLost.
+func (c *Client) recreateSpool(contactID uint64) {
+	spoolReaderChan, err := c.newContactSpool()
+	select {
+	case c.spoolRecoveryResultChan <- spoolRecoveryResult{
+		ContactID:       contactID,
+		SpoolReaderChan: spoolReaderChan,
+		Err:             err,
+	}:
+	case <-c.HaltCh():
+	}
+}
+
+// processSpoolRecoveryResult moves the contact to the recreated spool.
+// A failed recovery is retried the next time the lost spool is read.
+func (c *Client) processSpoolRecoveryResult(result spoolRecoveryResult) {
+	delete(c.spoolRecoveries, result.ContactID)
+	if result.Err != nil {
+		c.log.Errorf("failure to recreate spool: %s", result.Err)
+		return
+	}
+	contact, ok := c.contacts[result.ContactID]
+	if !ok || !contact.spoolLost {
+		go c.purgeSpool(result.SpoolReaderChan)
+		return
+	}
+	err := c.doRotateSpool(contact.nickname, result.SpoolReaderChan)
+	if err != nil {
+		c.log.Errorf("failure to replace lost spool of %s: %s", contact.nickname, err)
+	}
+}
+
+// SetSpoolRecovery enables or disables the automatic replacement of
+// lost spools, it is enabled by default. When it is disabled a lost
+// spool can be replaced with RotateSpool. It must be called before
+// Start.
+func (c *Client) SetSpoolRecovery(enabled bool) {
+	c.spoolRecovery = enabled
+}
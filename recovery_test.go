@@ -0,0 +1,66 @@
+// recovery_test.go - lost spool recovery tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSpoolRecovery(t *testing.T) {
+	spools := newFakeSpoolService()
+	alice := newTestClient(t, "alice", spools)
+	bob := newTestClient(t, "bob", spools)
+	pairTestClients(t, alice, bob)
+	contact := alice.contactNicknames["bob"]
+	lostSpool := contact.spoolReaderChan
+
+	// The Provider restarts and forgets the spool.
+	if err := spools.PurgeSpool(lostSpool.SpoolID, nil, "spool", "provider"); err != nil {
+		t.Fatal(err)
+	}
+	poll(alice)
+	waitEvent(t, alice, func(e Event) bool {
+		event, ok := e.(*SpoolLostEvent)
+		return ok && event.Nickname == "bob" && isSpoolNotFound(event.Err)
+	})
+	waitEvent(t, alice, func(e Event) bool {
+		event, ok := e.(*SpoolRecoveredEvent)
+		return ok && event.Nickname == "bob"
+	})
+	if contact.spoolLost {
+		t.Fatal("contact's spool is still marked as lost")
+	}
+	if bytes.Equal(contact.spoolReaderChan.SpoolID, lostSpool.SpoolID) || !spools.hasSpool(contact.spoolReaderChan.SpoolID) {
+		t.Fatal("spool was not recreated")
+	}
+
+	// Bob is told to write to the recreated spool.
+	poll(bob)
+	if !bytes.Equal(bob.contactNicknames["alice"].spoolWriterChan.SpoolID, contact.spoolReaderChan.SpoolID) {
+		t.Fatal("bob was not told of the recreated spool")
+	}
+	sendTestMessage(t, bob, "alice", "hello again")
+	settle(bob)
+	exchangeMessages(alice, bob)
+	if text := inboxText(alice); len(text) != 1 || text[0] != "hello again" {
+		t.Fatalf("got inbox %q", text)
+	}
+	if len(contact.oldSpoolReaderChans) != 0 {
+		t.Fatal("lost spool is still read")
+	}
+}
@@ -0,0 +1,158 @@
+// retention.go - disappearing messages
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// retentionCheckInterval is how often the worker
+// removes the messages whose retention period is over.
+const retentionCheckInterval = time.Minute
+
+type setRetention struct {
+	Name         string
+	Retention    time.Duration
+	Notify       bool
+	ResponseChan chan error
+}
+
+// SetRetention sets the default retention period of the messages
+// exchanged with contacts which have no retention period of their
+// own. Messages older than the retention period are removed from the
+// state, zero keeps messages forever. It must be called before Start.
+func (c *Client) SetRetention(retention time.Duration) {
+	c.retention = retention
+}
+
+// SetContactRetention sets the retention period of the messages
+// exchanged with the contact with the given nickname, overriding the
+// default retention period. Zero reverts to the default. If notify is
+// true the retention period is sent to the contact, whose client then
+// applies it to the conversation as well.
+func (c *Client) SetContactRetention(ctx context.Context, nickname string, retention time.Duration, notify bool) error {
+	if retention < 0 {
+		return fmt.Errorf("invalid retention period %s", retention)
+	}
+	responseChan := make(chan error, 1)
+	select {
+	case c.setRetentionChan <- setRetention{
+		Name:         nickname,
+		Retention:    retention,
+		Notify:       notify,
+		ResponseChan: responseChan,
+	}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.HaltCh():
+		return errHalted
+	}
+	return c.waitResponse(ctx, responseChan)
+}
+
+func (c *Client) doSetRetention(nickname string, retention time.Duration, notify bool) error {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return fmt.Errorf("contact %s not found", nickname)
+	}
+	if notify {
+		if contact.isPending {
+			return fmt.Errorf("key exchange with %s has not completed", nickname)
+		}
+		_, err := c.sendControlMessage(contact, &controlMessage{
+			Retention: &retention,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	contact.retention = retention
+	c.expireMessages()
+	c.save()
+	return nil
+}
+
+// contactRetention returns the retention period of the
+// messages exchanged with the contact with the given nickname.
+func (c *Client) contactRetention(nickname string) time.Duration {
+	contact, ok := c.contactNicknames[nickname]
+	if ok && contact.retention != 0 {
+		return contact.retention
+	}
+	return c.retention
+}
+
+func isExpired(t time.Time, retention time.Duration, now time.Time) bool {
+	return retention != 0 && now.Sub(t) > retention
+}
+
+// isSentMessageExpired returns true if the retention period of the sent
+// message is over, or if it is still queued for a contact which has
+// been removed and so will never be sent.
+func (c *Client) isSentMessageExpired(m *SentMessage, now time.Time) bool {
+	if _, ok := c.contactNicknames[m.Nickname]; !ok && m.Status == MessageQueued {
+		return true
+	}
+	return isExpired(m.SentTime, c.contactRetention(m.Nickname), now)
+}
+
+// expireMessages securely removes the received and sent messages whose
+// retention period is over and returns true if any were removed.
+func (c *Client) expireMessages() bool {
+	now := time.Now()
+	expired := 0
+
+	c.inboxMutex.Lock()
+	inbox := []*Message{}
+	for _, m := range c.inbox {
+		if isExpired(m.ReceivedTime, c.contactRetention(m.Nickname), now) {
+			wipe(m.Plaintext)
+			expired++
+			continue
+		}
+		inbox = append(inbox, m)
+	}
+	c.inbox = inbox
+	c.inboxMutex.Unlock()
+
+	c.sentMessagesMutex.Lock()
+	sent := []*SentMessage{}
+	for _, m := range c.sentMessages {
+		if c.isSentMessageExpired(m, now) {
+			wipe(m.Plaintext)
+			expired++
+			continue
+		}
+		sent = append(sent, m)
+	}
+	c.sentMessages = sent
+	c.sentMessagesMutex.Unlock()
+
+	if expired > 0 {
+		c.log.Debugf("removed %d expired messages", expired)
+	}
+	return expired > 0
+}
+
+// wipe overwrites the given plaintext.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
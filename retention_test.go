@@ -0,0 +1,69 @@
+// retention_test.go - message retention tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExpireSentMessages(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	tests := []struct {
+		name     string
+		nickname string
+		status   MessageStatus
+		sentTime time.Time
+		expired  bool
+	}{
+		{"recent sent message", "alice", MessageSent, time.Now(), false},
+		{"old sent message", "alice", MessageSent, old, true},
+		{"recent queued message", "alice", MessageQueued, time.Now(), false},
+		{"old queued message", "alice", MessageQueued, old, true},
+		{"queued message of removed contact", "bob", MessageQueued, time.Now(), true},
+		{"sent message of removed contact", "bob", MessageSent, time.Now(), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plaintext := []byte("hello")
+			c := &Client{
+				log:               testLog,
+				inboxMutex:        new(sync.Mutex),
+				sentMessagesMutex: new(sync.Mutex),
+				contactNicknames:  map[string]*Contact{"alice": {nickname: "alice"}},
+				retention:         time.Hour,
+				sentMessages: []*SentMessage{{
+					ID:        1,
+					Nickname:  test.nickname,
+					Plaintext: plaintext,
+					Status:    test.status,
+					SentTime:  test.sentTime,
+				}},
+			}
+			if expired := c.expireMessages(); expired != test.expired {
+				t.Fatalf("got expired %v, want %v", expired, test.expired)
+			}
+			if (len(c.sentMessages) == 0) != test.expired {
+				t.Fatalf("%d sent messages left", len(c.sentMessages))
+			}
+			if test.expired && plaintext[0] != 0 {
+				t.Fatal("expired message was not wiped")
+			}
+		})
+	}
+}
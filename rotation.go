@@ -0,0 +1,212 @@
+// rotation.go - remote spool rotation
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/katzenpost/channels"
+	"github.com/ugorji/go/codec"
+)
+
+// controlMessage is sent to a contact to change how we communicate
+// with them. The fields which are not set are left unchanged.
+type controlMessage struct {
+	// SpoolWriter is the spool the contact must write to from now on.
+	SpoolWriter *channels.UnreliableSpoolWriterChannel
+
+	// Retention is the retention period of the messages of the
+	// conversation chosen by the sender, zero reverts to the
+	// receiver's default retention period.
+	Retention *time.Duration
+}
+
+// sendControlMessage sends the control message to the contact and
+// returns its ID, which the contact acknowledges once it has been
+// applied.
+func (c *Client) sendControlMessage(contact *Contact, control *controlMessage) (MessageID, error) {
+	var payload []byte
+	err := codec.NewEncoderBytes(&payload, cborHandle).Encode(control)
+	if err != nil {
+		return 0, err
+	}
+	id := newMessageID()
+	return id, c.sendPayload(contact, messageTypeControl, id, payload)
+}
+
+// processControlMessage applies the control message sent by the contact.
+func (c *Client) processControlMessage(contact *Contact, body []byte) {
+	control := new(controlMessage)
+	err := codec.NewDecoderBytes(body, cborHandle).Decode(control)
+	if err != nil {
+		c.log.Errorf("failure to decode control message from %s: %s", contact.nickname, err)
+		return
+	}
+	if control.SpoolWriter != nil {
+		c.log.Infof("%s has moved to a new spool.", contact.nickname)
+		contact.spoolWriterChan = control.SpoolWriter
+	}
+	if control.Retention != nil && *control.Retention >= 0 {
+		c.log.Infof("%s set the retention period of the conversation to %s.", contact.nickname, *control.Retention)
+		contact.retention = *control.Retention
+		c.emitEvent(&RetentionChangedEvent{
+			Nickname:  contact.nickname,
+			Retention: contact.retention,
+		})
+	}
+}
+
+// RotateSpool moves the contact with the given nickname to a new remote
+// spool. The new spool is sent to the contact in a control message, and
+// the old spool is read until the contact has switched to the new spool
+// and then purged. A contact writing to the shared spool is moved to a
+// spool of its own, the shared spool is purged once no contact writes
+// to it.
+func (c *Client) RotateSpool(ctx context.Context, nickname string) error {
+	spoolReaderChan, err := c.newContactSpoolContext(ctx)
+	if err != nil {
+		return err
+	}
+	responseChan := make(chan error, 1)
+	select {
+	case c.rotateSpoolChan <- rotateSpool{
+		Name:            nickname,
+		SpoolReaderChan: spoolReaderChan,
+		ResponseChan:    responseChan,
+	}:
+	case <-ctx.Done():
+		go c.purgeSpool(spoolReaderChan)
+		return ctx.Err()
+	case <-c.HaltCh():
+		go c.purgeSpool(spoolReaderChan)
+		return errHalted
+	}
+	return c.waitResponse(ctx, responseChan)
+}
+
+func (c *Client) doRotateSpool(nickname string, spoolReaderChan *channels.UnreliableSpoolReaderChannel) error {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		go c.purgeSpool(spoolReaderChan)
+		return fmt.Errorf("contact %s not found", nickname)
+	}
+	if contact.isPending {
+		go c.purgeSpool(spoolReaderChan)
+		return fmt.Errorf("key exchange with %s has not completed", nickname)
+	}
+	control := &controlMessage{
+		SpoolWriter: spoolReaderChan.GetSpoolWriter(),
+	}
+	id, err := c.sendControlMessage(contact, control)
+	if err != nil {
+		go c.purgeSpool(spoolReaderChan)
+		return err
+	}
+	if contact.spoolReaderChan == nil {
+		contact.leavingSharedSpool = true
+	} else {
+		contact.oldSpoolReaderChans = append(contact.oldSpoolReaderChans, contact.spoolReaderChan)
+	}
+	contact.spoolReaderChan = spoolReaderChan
+	contact.rotationID = id
+	contact.rotationAckTime = time.Time{}
+	c.log.Infof("Rotated spool of %s.", nickname)
+	if contact.spoolLost {
+		contact.spoolLost = false
+		c.emitEvent(&SpoolRecoveredEvent{
+			Nickname: nickname,
+		})
+	}
+	c.save()
+	return nil
+}
+
+// retireDrainedSpool purges a spool which has been drained by a read
+// job started after the contacts writing to it acknowledged the switch
+// to their new spool. It returns true if the state changed.
+func (c *Client) retireDrainedSpool(contactID uint64, spoolID []byte, readStartTime time.Time) bool {
+	if contactID == sharedSpoolID {
+		changed := false
+		for _, contact := range c.contacts {
+			if contact.leavingSharedSpool && c.hasSwitchedSpool(contact, readStartTime) {
+				contact.leavingSharedSpool = false
+				changed = true
+			}
+		}
+		if changed {
+			c.purgeUnusedSharedSpool()
+		}
+		return changed
+	}
+	contact, ok := c.contacts[contactID]
+	if !ok || !c.hasSwitchedSpool(contact, readStartTime) {
+		return false
+	}
+	for i, reader := range contact.oldSpoolReaderChans {
+		if bytes.Equal(reader.SpoolID, spoolID) {
+			contact.oldSpoolReaderChans = append(contact.oldSpoolReaderChans[:i], contact.oldSpoolReaderChans[i+1:]...)
+			c.log.Debugf("retiring old spool of %s", contact.nickname)
+			go c.purgeSpool(reader)
+			return true
+		}
+	}
+	return false
+}
+
+// hasSwitchedSpool returns true if the contact acknowledged the switch
+// to its current spool before the given time. The contact applies the
+// control message before acknowledging it and writes to its spool in
+// order, so all its writes to the old spools were done by then.
+func (c *Client) hasSwitchedSpool(contact *Contact, t time.Time) bool {
+	return !contact.rotationAckTime.IsZero() && contact.rotationAckTime.Before(t)
+}
+
+// processRotationAck records the contact's acknowledgement of the
+// control message sent by the last spool rotation and returns false
+// if the acknowledged message is another one.
+func (c *Client) processRotationAck(contact *Contact, id MessageID) bool {
+	if id != contact.rotationID || !contact.rotationAckTime.IsZero() {
+		return false
+	}
+	c.log.Debugf("%s has switched to the new spool", contact.nickname)
+	contact.rotationAckTime = time.Now()
+	return true
+}
+
+// purgeUnusedSharedSpool purges the shared
+// spool once no contact writes to it.
+func (c *Client) purgeUnusedSharedSpool() {
+	if c.spoolReaderChan == nil || !c.sharedSpoolUnused() {
+		return
+	}
+	c.log.Info("No contact writes to the shared spool, purging it.")
+	go c.purgeSpool(c.spoolReaderChan)
+	c.spoolReaderChan = nil
+}
+
+// sharedSpoolUnused returns true if no contact writes to the shared spool.
+func (c *Client) sharedSpoolUnused() bool {
+	for _, contact := range c.contacts {
+		if contact.readsSharedSpool() {
+			return false
+		}
+	}
+	return true
+}
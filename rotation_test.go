@@ -0,0 +1,88 @@
+// rotation_test.go - spool rotation tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"testing"
+	"time"
+)
+
+// waitPurged waits for the asynchronous purge of the spool.
+func waitPurged(t *testing.T, spools *fakeSpoolService, spoolID []byte) {
+	deadline := time.Now().Add(10 * time.Second)
+	for spools.hasSpool(spoolID) {
+		if time.Now().After(deadline) {
+			t.Fatal("spool was not purged")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRotateSpool(t *testing.T) {
+	spools := newFakeSpoolService()
+	alice := newTestClient(t, "alice", spools)
+	bob := newTestClient(t, "bob", spools)
+	pairTestClients(t, alice, bob)
+	contact := alice.contactNicknames["bob"]
+	oldSpool := contact.spoolReaderChan
+
+	// Bob writes to the old spool before he learns of the new one.
+	sendTestMessage(t, bob, "alice", "before")
+	settle(bob)
+	newSpool, err := alice.newContactSpool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.doRotateSpool("bob", newSpool); err != nil {
+		t.Fatal(err)
+	}
+	settle(alice)
+
+	// The old spool is drained, but bob hasn't switched yet.
+	poll(alice)
+	if len(contact.oldSpoolReaderChans) != 1 || !spools.hasSpool(oldSpool.SpoolID) {
+		t.Fatal("old spool was retired before the rotation was acknowledged")
+	}
+
+	// Bob switches and acknowledges, alice reads the acknowledgement
+	// in the same poll as the old spool, which is kept until a read
+	// started after the acknowledgement finds it empty.
+	poll(bob)
+	poll(alice)
+	if contact.rotationAckTime.IsZero() {
+		t.Fatal("rotation was not acknowledged")
+	}
+	if len(contact.oldSpoolReaderChans) != 1 {
+		t.Fatal("old spool was retired by a read started before the acknowledgement")
+	}
+	poll(alice)
+	if len(contact.oldSpoolReaderChans) != 0 {
+		t.Fatal("drained old spool was not retired")
+	}
+	waitPurged(t, spools, oldSpool.SpoolID)
+
+	sendTestMessage(t, bob, "alice", "after")
+	settle(bob)
+	if len(spools.spool(newSpool.SpoolID)) == 0 {
+		t.Fatal("bob didn't write to the new spool")
+	}
+	poll(alice)
+	text := inboxText(alice)
+	if len(text) != 2 || text[0] != "before" || text[1] != "after" {
+		t.Fatalf("got inbox %q", text)
+	}
+}
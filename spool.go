@@ -0,0 +1,309 @@
+// spool.go - remote spool helpers
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/channels"
+)
+
+// sharedSpoolID identifies the Client's shared spool where contact IDs
+// are used to identify spools. It is never assigned to a contact.
+const sharedSpoolID uint64 = 0
+
+// readInboxResult is a message read from a remote spool by a read job,
+// or the end of a read job when Done is set. Err is set if the read
+// job ended because a read failed. ContactID and SpoolID identify the
+// spool and StartTime is the time the read job started.
+type readInboxResult struct {
+	ContactID  uint64
+	SpoolID    []byte
+	StartTime  time.Time
+	Ciphertext []byte
+	Done       bool
+	Err        error
+}
+
+// defaultSpoolDrainLimit is the default maximum number of
+// messages read from the remote spool per poll.
+const defaultSpoolDrainLimit = 10
+
+// isSpoolCommandFailure returns true if the error was
+// reported by the spool service rather than the mixnet.
+func isSpoolCommandFailure(err error) bool {
+	return strings.HasPrefix(err.Error(), "spool command failure")
+}
+
+// isSpoolNotFound returns true if the spool command failed because the
+// spool doesn't exist. The spool service keeps its spools in memory, so
+// they are lost when the Provider restarts.
+func isSpoolNotFound(err error) bool {
+	return isSpoolCommandFailure(err) && strings.Contains(err.Error(), "spool not found")
+}
+
+// spoolNoMessageStatus is the failure status the spool service
+// replies with when there is no message at the read offset.
+const spoolNoMessageStatus = "message ID not found"
+
+// isSpoolEmpty returns true if a spool read failed because there is
+// no message at the read offset. Any other failure is a read error.
+func isSpoolEmpty(err error) bool {
+	return err.Error() == "spool command failure: "+spoolNoMessageStatus
+}
+
+// maxSpoolReadJobs is the maximum number of
+// spool read jobs in flight at the same time.
+const maxSpoolReadJobs = 4
+
+// spoolRead is a spool to be read by a read job.
+type spoolRead struct {
+	ContactID       uint64
+	SpoolReaderChan *channels.UnreliableSpoolReaderChannel
+}
+
+// readInbox starts read jobs which read messages from the remote spools
+// until they have no more messages or the drain limit is reached. There
+// is a read job for the spool of each contact whose key exchange has
+// completed, for the spools contacts are switching away from, and for
+// the shared spool if any contact still writes to it. Only one read
+// job per spool runs at a time and at most maxSpoolReadJobs at all,
+// each poll starts with the spool after the last one the previous poll
+// got to so that every spool is read in turn.
+func (c *Client) readInbox() {
+	spools := c.spoolsToRead()
+	i := 0
+	for ; i < len(spools) && len(c.readsInFlight) < maxSpoolReadJobs; i++ {
+		s := spools[(c.readCursor+i)%len(spools)]
+		c.startReadJob(s.ContactID, s.SpoolReaderChan)
+	}
+	if len(spools) > 0 {
+		c.readCursor = (c.readCursor + i) % len(spools)
+	}
+}
+
+// spoolsToRead returns the spools read by readInbox,
+// in the order of the IDs of the contacts they belong to.
+func (c *Client) spoolsToRead() []spoolRead {
+	contacts := []*Contact{}
+	for _, contact := range c.contacts {
+		contacts = append(contacts, contact)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].id < contacts[j].id
+	})
+	spools := []spoolRead{}
+	readShared := false
+	for _, contact := range contacts {
+		if contact.readsSharedSpool() {
+			readShared = true
+		}
+		for _, reader := range contact.oldSpoolReaderChans {
+			spools = append(spools, spoolRead{contact.id, reader})
+		}
+		if contact.spoolReaderChan != nil && !contact.isPending {
+			spools = append(spools, spoolRead{contact.id, contact.spoolReaderChan})
+		}
+	}
+	if readShared && c.spoolReaderChan != nil {
+		spools = append(spools, spoolRead{sharedSpoolID, c.spoolReaderChan})
+	}
+	return spools
+}
+
+func (c *Client) startReadJob(contactID uint64, spoolReaderChan *channels.UnreliableSpoolReaderChannel) {
+	if c.readsInFlight[string(spoolReaderChan.SpoolID)] {
+		return
+	}
+	c.readsInFlight[string(spoolReaderChan.SpoolID)] = true
+	// The job reads from a copy of the reader so that only the
+	// worker advances the read offset as it processes the results.
+	reader := *spoolReaderChan
+	go c.readSpool(contactID, &reader, time.Now(), c.spoolDrainLimit)
+}
+
+// readSpool is run in its own goroutine by startReadJob.
+func (c *Client) readSpool(contactID uint64, reader *channels.UnreliableSpoolReaderChannel, startTime time.Time, limit int) {
+	for i := 0; i < limit; i++ {
+		ciphertext, err := reader.Read(c.spoolService)
+		if err != nil {
+			c.postReadInboxResult(readInboxResult{
+				ContactID: contactID,
+				SpoolID:   reader.SpoolID,
+				StartTime: startTime,
+				Done:      true,
+				Err:       err,
+			})
+			return
+		}
+		if !c.postReadInboxResult(readInboxResult{
+			ContactID:  contactID,
+			SpoolID:    reader.SpoolID,
+			Ciphertext: ciphertext,
+		}) {
+			return
+		}
+	}
+	c.postReadInboxResult(readInboxResult{
+		ContactID: contactID,
+		SpoolID:   reader.SpoolID,
+		StartTime: startTime,
+		Done:      true,
+	})
+}
+
+func (c *Client) postReadInboxResult(result readInboxResult) bool {
+	select {
+	case c.readInboxResultChan <- result:
+		return true
+	case <-c.HaltCh():
+		return false
+	}
+}
+
+// processReadInboxResult advances the read offset and decrypts the
+// message read by the read job. It returns true if the state changed.
+func (c *Client) processReadInboxResult(result readInboxResult) bool {
+	if result.Done {
+		delete(c.readsInFlight, string(result.SpoolID))
+		if result.Err == nil {
+			return false
+		}
+		c.updateConnectionStatus(result.Err)
+		if isSpoolNotFound(result.Err) {
+			return c.processLostSpool(result.ContactID, result.SpoolID, result.Err)
+		}
+		if !isSpoolEmpty(result.Err) {
+			c.log.Debugf("failure reading remote spool: %s", result.Err)
+			return false
+		}
+		c.log.Debug("remote spool has no more messages")
+		return c.retireDrainedSpool(result.ContactID, result.SpoolID, result.StartTime)
+	}
+	c.updateConnectionStatus(nil)
+	reader := c.findSpoolReader(result.ContactID, result.SpoolID)
+	if reader == nil {
+		// The contact was removed or the spool
+		// was retired during the read.
+		return false
+	}
+	reader.ReadOffset++
+	c.decryptMessage(result.ContactID, result.Ciphertext)
+	return true
+}
+
+// findSpoolReader returns the reader of the spool with the given ID
+// which belongs to the contact with the given ID, or nil if there is
+// no such spool.
+func (c *Client) findSpoolReader(contactID uint64, spoolID []byte) *channels.UnreliableSpoolReaderChannel {
+	if contactID == sharedSpoolID {
+		if c.spoolReaderChan == nil || !bytes.Equal(c.spoolReaderChan.SpoolID, spoolID) {
+			return nil
+		}
+		return c.spoolReaderChan
+	}
+	contact, ok := c.contacts[contactID]
+	if !ok {
+		return nil
+	}
+	if contact.spoolReaderChan != nil && bytes.Equal(contact.spoolReaderChan.SpoolID, spoolID) {
+		return contact.spoolReaderChan
+	}
+	for _, reader := range contact.oldSpoolReaderChans {
+		if bytes.Equal(reader.SpoolID, spoolID) {
+			return reader
+		}
+	}
+	return nil
+}
+
+// contactSpoolReader returns the reader of
+// the spool the contact writes to.
+func (c *Client) contactSpoolReader(contact *Contact) *channels.UnreliableSpoolReaderChannel {
+	if contact.spoolReaderChan != nil {
+		return contact.spoolReaderChan
+	}
+	return c.spoolReaderChan
+}
+
+// newContactSpool creates a remote spool dedicated to a new contact's
+// messages. It performs a mixnet round trip and so it is called before
+// the new contact is handed to the worker.
+func (c *Client) newContactSpool() (*channels.UnreliableSpoolReaderChannel, error) {
+	desc, err := c.spoolDescriptor()
+	if err != nil {
+		return nil, err
+	}
+	return channels.NewUnreliableSpoolReaderChannel(desc.Name, desc.Provider, c.spoolService)
+}
+
+// spoolCreationResult is the outcome of a spool creation
+// started by newContactSpoolContext.
+type spoolCreationResult struct {
+	SpoolReaderChan *channels.UnreliableSpoolReaderChannel
+	Err             error
+}
+
+// newContactSpoolContext is like newContactSpool except that it gives
+// up waiting for the spool once the context is done or the Client is
+// halted. A spool created after giving up is purged.
+func (c *Client) newContactSpoolContext(ctx context.Context) (*channels.UnreliableSpoolReaderChannel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	resultChan := make(chan spoolCreationResult, 1)
+	go func() {
+		spoolReaderChan, err := c.newContactSpool()
+		resultChan <- spoolCreationResult{
+			SpoolReaderChan: spoolReaderChan,
+			Err:             err,
+		}
+	}()
+	select {
+	case result := <-resultChan:
+		return result.SpoolReaderChan, result.Err
+	case <-ctx.Done():
+		go c.purgeCreatedSpool(resultChan)
+		return nil, ctx.Err()
+	case <-c.HaltCh():
+		go c.purgeCreatedSpool(resultChan)
+		return nil, errHalted
+	}
+}
+
+// purgeCreatedSpool purges the spool created by an abandoned
+// newContactSpoolContext call, once it has been created.
+func (c *Client) purgeCreatedSpool(resultChan chan spoolCreationResult) {
+	result := <-resultChan
+	if result.Err == nil {
+		c.purgeSpool(result.SpoolReaderChan)
+	}
+}
+
+// purgeSpool removes a remote spool which is no longer read.
+func (c *Client) purgeSpool(reader *channels.UnreliableSpoolReaderChannel) {
+	err := c.spoolService.PurgeSpool(reader.SpoolID, reader.SpoolPrivateKey, reader.SpoolReceiver, reader.SpoolProvider)
+	if err != nil {
+		c.log.Errorf("failure to purge remote spool: %s", err)
+		return
+	}
+	c.log.Debug("remote spool purged successfully")
+}
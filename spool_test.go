@@ -0,0 +1,103 @@
+// spool_test.go - remote spool tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIsSpoolEmpty(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		empty bool
+	}{
+		{"no message", spoolFailure(spoolNoMessageStatus), true},
+		{"spool not found", spoolFailure("spool not found"), false},
+		{"other failure", spoolFailure("invalid signature"), false},
+		{"mixnet failure", errTestMixnet, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if empty := isSpoolEmpty(test.err); empty != test.empty {
+				t.Fatalf("got empty %v, want %v", empty, test.empty)
+			}
+		})
+	}
+}
+
+func TestReadInboxBound(t *testing.T) {
+	spools := newFakeSpoolService()
+	alice := newTestClient(t, "alice", spools)
+	for i := 0; i < maxSpoolReadJobs+2; i++ {
+		pairTestClients(t, alice, newTestClient(t, fmt.Sprintf("contact %d", i), spools))
+	}
+
+	read := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		alice.readInbox()
+		if len(alice.readsInFlight) != maxSpoolReadJobs {
+			t.Fatalf("got %d read jobs, want %d", len(alice.readsInFlight), maxSpoolReadJobs)
+		}
+		for spoolID := range alice.readsInFlight {
+			read[spoolID] = true
+		}
+		settle(alice)
+	}
+	if len(read) != len(alice.contacts) {
+		t.Fatalf("%d of %d spools were read in two polls", len(read), len(alice.contacts))
+	}
+}
+
+func TestContactSpoolContext(t *testing.T) {
+	spools := newFakeSpoolService()
+	c := newTestClient(t, "alice", spools)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.AddContact(ctx, "bob", []byte("secret")); err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if created, _ := spools.counts(); created != 0 {
+		t.Fatal("spool was created for a cancelled call")
+	}
+
+	spools.createBlock = make(chan struct{})
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.AddManualContact(ctx, "bob"); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	close(spools.createBlock)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		created, existing := spools.counts()
+		if created == 1 && existing == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d spools created after the deadline were left behind", existing, created)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(c.contacts) != 0 {
+		t.Fatal("contact was added after the deadline")
+	}
+}
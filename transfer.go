@@ -0,0 +1,723 @@
+// transfer.go - file transfers between contacts
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	// MaxFileSize is the maximum size of a file
+	// which can be sent to a contact.
+	MaxFileSize = 1 << 20
+
+	// fileChunkLength is the number of bytes of a file sent in each
+	// chunk, small enough for a chunk to fit a single ratchet payload.
+	fileChunkLength = maxEnvelopeLength - 2*envelopeOverhead
+
+	// maxFileChunks is the number of chunks of a file of MaxFileSize.
+	maxFileChunks = (MaxFileSize + fileChunkLength - 1) / fileChunkLength
+
+	// fileChunkWindow is the number of chunks of an outgoing transfer
+	// in the outbox at the same time, the next chunk is queued as each
+	// one is written to the contact's spool.
+	fileChunkWindow = 8
+
+	// fileResumeInterval is how long the receiver of a file waits for
+	// the next chunk before asking the sender for the missing chunks.
+	fileResumeInterval = time.Hour
+
+	// fileOfferTimeout is how long a file offered by
+	// a contact is kept around waiting to be accepted.
+	fileOfferTimeout = 7 * 24 * time.Hour
+
+	// fileTransferTimeout is how long an outgoing transfer is kept
+	// around without any news from the receiver before it fails.
+	fileTransferTimeout = 7 * 24 * time.Hour
+
+	// defaultDownloadDir is the default directory received files are
+	// written to.
+	defaultDownloadDir = "downloads"
+)
+
+const (
+	// fileOffer offers a file to the contact.
+	fileOffer uint8 = iota
+	// fileAccept accepts a file offered by the contact.
+	fileAccept
+	// fileChunk carries a piece of the file.
+	fileChunk
+	// fileResume asks the sender for the missing chunks.
+	fileResume
+	// fileComplete tells the sender that the transfer ended,
+	// Err is set if the file was not received intact.
+	fileComplete
+)
+
+// TransferStatus is the status of a file transfer.
+type TransferStatus uint8
+
+const (
+	// TransferOffered means the file was offered but not yet accepted.
+	TransferOffered TransferStatus = iota
+	// TransferInProgress means the file chunks are being sent.
+	TransferInProgress
+	// TransferComplete means the file was received and verified.
+	TransferComplete
+	// TransferFailed means the file was not received intact.
+	TransferFailed
+)
+
+// String returns a string representation of the TransferStatus.
+func (s TransferStatus) String() string {
+	switch s {
+	case TransferOffered:
+		return "offered"
+	case TransferInProgress:
+		return "in progress"
+	case TransferComplete:
+		return "complete"
+	case TransferFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// fileMessage is the body of a message of type messageTypeFile.
+type fileMessage struct {
+	Kind       uint8
+	TransferID MessageID
+	Name       string
+	Size       uint64
+	Hash       []byte
+	ChunkCount uint32
+	Index      uint32
+	Data       []byte
+	Missing    []uint32
+	Err        string
+}
+
+// fileTransfer is a file being sent to or received from a contact.
+// Outgoing transfers keep the file until the receiver reports the end
+// of the transfer so that missing chunks can be sent again, along with
+// the indexes of the chunks waiting for room in the window and the IDs
+// of the chunks in the outbox. Incoming transfers keep the chunks
+// received so far.
+type fileTransfer struct {
+	ID           MessageID
+	ContactID    uint64
+	Nickname     string
+	Name         string
+	Size         uint64
+	Hash         []byte
+	Outgoing     bool
+	Status       TransferStatus
+	ChunkCount   uint32
+	ChunksDone   uint32
+	Data         []byte
+	Chunks       [][]byte
+	Received     []bool
+	Pending      []uint32
+	ChunkIDs     []MessageID
+	Path         string
+	Err          string
+	StartTime    time.Time
+	LastActivity time.Time
+}
+
+// FileTransferInfo is a snapshot of a file transfer's status.
+type FileTransferInfo struct {
+	// ID identifies the transfer.
+	ID MessageID
+	// Nickname is the nickname of the contact.
+	Nickname string
+	// Name is the name of the file.
+	Name string
+	// Size is the size of the file in bytes.
+	Size uint64
+	// Outgoing is true if we are sending the file.
+	Outgoing bool
+	// Status is the status of the transfer.
+	Status TransferStatus
+	// ChunksDone is the number of chunks written to the contact's
+	// spool for outgoing transfers, or received for incoming ones.
+	ChunksDone uint32
+	// ChunkCount is the number of chunks the file is split into.
+	ChunkCount uint32
+	// Path is where a received file was written.
+	Path string
+	// Err is the reason the transfer failed.
+	Err string
+	// StartTime is the time the transfer was offered.
+	StartTime time.Time
+}
+
+type sendFile struct {
+	ID           MessageID
+	Name         string
+	FileName     string
+	Data         []byte
+	ResponseChan chan error
+}
+
+type acceptFile struct {
+	ID           MessageID
+	ResponseChan chan error
+}
+
+// SendFile offers the file at the given path to the contact with the
+// given nickname and returns the ID of the transfer. The file is sent
+// once the contact accepts it, its progress is reported by GetTransfers
+// and its end by a FileTransferCompletedEvent.
+func (c *Client) SendFile(ctx context.Context, nickname, path string) (MessageID, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) > MaxFileSize {
+		return 0, fmt.Errorf("file exceeds maximum size of %d bytes", MaxFileSize)
+	}
+	id := newMessageID()
+	responseChan := make(chan error, 1)
+	select {
+	case c.sendFileChan <- sendFile{
+		ID:           id,
+		Name:         nickname,
+		FileName:     filepath.Base(path),
+		Data:         data,
+		ResponseChan: responseChan,
+	}:
+	case <-ctx.Done():
+		return id, ctx.Err()
+	case <-c.HaltCh():
+		return id, errHalted
+	}
+	return id, c.waitResponse(ctx, responseChan)
+}
+
+// AcceptFile accepts the file offered in the transfer with the given ID.
+func (c *Client) AcceptFile(ctx context.Context, id MessageID) error {
+	responseChan := make(chan error, 1)
+	select {
+	case c.acceptFileChan <- acceptFile{
+		ID:           id,
+		ResponseChan: responseChan,
+	}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.HaltCh():
+		return errHalted
+	}
+	return c.waitResponse(ctx, responseChan)
+}
+
+// GetTransfers returns a snapshot of the status of each file transfer.
+func (c *Client) GetTransfers() []*FileTransferInfo {
+	responseChan := make(chan []*FileTransferInfo)
+	c.getTransfersChan <- responseChan
+	return <-responseChan
+}
+
+// SetDownloadDir sets the directory received files are written
+// to. It must be called before Start.
+func (c *Client) SetDownloadDir(dir string) {
+	c.downloadDir = dir
+}
+
+func (c *Client) transferInfos() []*FileTransferInfo {
+	infos := []*FileTransferInfo{}
+	for _, t := range c.transfers {
+		infos = append(infos, &FileTransferInfo{
+			ID:         t.ID,
+			Nickname:   t.Nickname,
+			Name:       t.Name,
+			Size:       t.Size,
+			Outgoing:   t.Outgoing,
+			Status:     t.Status,
+			ChunksDone: t.ChunksDone,
+			ChunkCount: t.ChunkCount,
+			Path:       t.Path,
+			Err:        t.Err,
+			StartTime:  t.StartTime,
+		})
+	}
+	return infos
+}
+
+func (c *Client) findTransfer(id MessageID, contactID uint64, outgoing bool) *fileTransfer {
+	for _, t := range c.transfers {
+		if t.ID == id && t.ContactID == contactID && t.Outgoing == outgoing {
+			return t
+		}
+	}
+	return nil
+}
+
+func (c *Client) sendFileMessage(contact *Contact, m *fileMessage) error {
+	var payload []byte
+	err := codec.NewEncoderBytes(&payload, cborHandle).Encode(m)
+	if err != nil {
+		return err
+	}
+	return c.sendPayload(contact, messageTypeFile, newMessageID(), payload)
+}
+
+func (c *Client) doSendFile(id MessageID, nickname, fileName string, data []byte) error {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return fmt.Errorf("contact %s not found", nickname)
+	}
+	if contact.isPending {
+		return fmt.Errorf("key exchange with %s has not completed", nickname)
+	}
+	if contact.peerVersion < envelopeVersion {
+		return fmt.Errorf("%s does not support file transfers", nickname)
+	}
+	hash := sha256.Sum256(data)
+	chunkCount := (len(data) + fileChunkLength - 1) / fileChunkLength
+	if chunkCount == 0 {
+		chunkCount = 1
+	}
+	t := &fileTransfer{
+		ID:           id,
+		ContactID:    contact.id,
+		Nickname:     nickname,
+		Name:         fileName,
+		Size:         uint64(len(data)),
+		Hash:         hash[:],
+		Outgoing:     true,
+		Status:       TransferOffered,
+		ChunkCount:   uint32(chunkCount),
+		Data:         data,
+		StartTime:    time.Now(),
+		LastActivity: time.Now(),
+	}
+	err := c.sendFileMessage(contact, &fileMessage{
+		Kind:       fileOffer,
+		TransferID: t.ID,
+		Name:       t.Name,
+		Size:       t.Size,
+		Hash:       t.Hash,
+		ChunkCount: t.ChunkCount,
+	})
+	if err != nil {
+		return err
+	}
+	c.transfers = append(c.transfers, t)
+	c.log.Infof("Offered file %s to %s.", fileName, nickname)
+	c.save()
+	return nil
+}
+
+func (c *Client) doAcceptFile(id MessageID) error {
+	var t *fileTransfer
+	for _, transfer := range c.transfers {
+		if transfer.ID == id && !transfer.Outgoing {
+			t = transfer
+			break
+		}
+	}
+	if t == nil {
+		return fmt.Errorf("file transfer %s not found", id)
+	}
+	if t.Status != TransferOffered {
+		return fmt.Errorf("file transfer %s is %s", id, t.Status)
+	}
+	contact, ok := c.contacts[t.ContactID]
+	if !ok {
+		return fmt.Errorf("contact %s not found", t.Nickname)
+	}
+	err := c.sendFileMessage(contact, &fileMessage{
+		Kind:       fileAccept,
+		TransferID: t.ID,
+	})
+	if err != nil {
+		return err
+	}
+	t.Status = TransferInProgress
+	t.Chunks = make([][]byte, t.ChunkCount)
+	t.Received = make([]bool, t.ChunkCount)
+	t.LastActivity = time.Now()
+	c.save()
+	return nil
+}
+
+// sendFileChunks adds the chunks of the outgoing transfer with the
+// given indexes to those waiting to be sent and queues as many of them
+// as the window allows before the state is saved and the outbox flushed.
+func (c *Client) sendFileChunks(contact *Contact, t *fileTransfer, indexes []uint32) {
+	for _, i := range indexes {
+		if i < t.ChunkCount && !t.isPending(i) {
+			t.Pending = append(t.Pending, i)
+		}
+	}
+	c.fillChunkWindow(contact, t)
+	c.save()
+	c.flushOutbox()
+}
+
+// isPending returns true if the chunk with the
+// given index is waiting for room in the window.
+func (t *fileTransfer) isPending(index uint32) bool {
+	for _, i := range t.Pending {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+// fillChunkWindow queues pending chunks of the outgoing transfer
+// until fileChunkWindow of its chunks are in the outbox. Chunks
+// dropped from the outbox, as it is when the key exchange is
+// restarted, no longer take room in the window.
+func (c *Client) fillChunkWindow(contact *Contact, t *fileTransfer) {
+	chunkIDs := []MessageID{}
+	for _, id := range t.ChunkIDs {
+		if c.isQueued(contact.id, id) {
+			chunkIDs = append(chunkIDs, id)
+		}
+	}
+	t.ChunkIDs = chunkIDs
+	for len(t.Pending) > 0 && len(t.ChunkIDs) < fileChunkWindow {
+		i := t.Pending[0]
+		end := (int(i) + 1) * fileChunkLength
+		if end > len(t.Data) {
+			end = len(t.Data)
+		}
+		var payload []byte
+		err := codec.NewEncoderBytes(&payload, cborHandle).Encode(&fileMessage{
+			Kind:       fileChunk,
+			TransferID: t.ID,
+			Index:      i,
+			Data:       t.Data[int(i)*fileChunkLength : end],
+		})
+		if err != nil {
+			c.log.Errorf("failure to encode chunk of %s: %s", t.Name, err)
+			return
+		}
+		chunkID := newMessageID()
+		err = c.queuePayload(contact, messageTypeFile, chunkID, payload)
+		if err != nil {
+			c.log.Errorf("failure to send chunk of %s to %s: %s", t.Name, contact.nickname, err)
+			return
+		}
+		t.Pending = t.Pending[1:]
+		t.ChunkIDs = append(t.ChunkIDs, chunkID)
+	}
+}
+
+// isQueued returns true if the outbox holds the
+// message with the given ID sent to the contact.
+func (c *Client) isQueued(contactID uint64, id MessageID) bool {
+	for _, e := range c.outbox {
+		if e.MessageID == id && e.ContactID == contactID {
+			return true
+		}
+	}
+	return false
+}
+
+// fileChunkWritten counts the chunk written to the contact's spool
+// towards the progress of its outgoing transfer, and queues the next
+// pending chunk in its place.
+func (c *Client) fileChunkWritten(id MessageID) {
+	for _, t := range c.transfers {
+		if !t.Outgoing {
+			continue
+		}
+		for i, chunkID := range t.ChunkIDs {
+			if chunkID != id {
+				continue
+			}
+			t.ChunkIDs = append(t.ChunkIDs[:i], t.ChunkIDs[i+1:]...)
+			if t.ChunksDone < t.ChunkCount {
+				t.ChunksDone++
+			}
+			contact, ok := c.contacts[t.ContactID]
+			if ok && t.Status == TransferInProgress {
+				c.fillChunkWindow(contact, t)
+			}
+			return
+		}
+	}
+}
+
+// processFileMessage handles a file transfer message from the contact.
+func (c *Client) processFileMessage(contact *Contact, body []byte) {
+	m := new(fileMessage)
+	err := codec.NewDecoderBytes(body, cborHandle).Decode(m)
+	if err != nil {
+		c.log.Errorf("failure to decode file message from %s: %s", contact.nickname, err)
+		return
+	}
+	switch m.Kind {
+	case fileOffer:
+		c.processFileOffer(contact, m)
+	case fileAccept:
+		t := c.findTransfer(m.TransferID, contact.id, true)
+		if t == nil || t.Status != TransferOffered {
+			return
+		}
+		c.log.Infof("%s accepted file %s.", contact.nickname, t.Name)
+		t.Status = TransferInProgress
+		t.LastActivity = time.Now()
+		indexes := make([]uint32, t.ChunkCount)
+		for i := range indexes {
+			indexes[i] = uint32(i)
+		}
+		c.sendFileChunks(contact, t, indexes)
+	case fileChunk:
+		c.processFileChunk(contact, m)
+	case fileResume:
+		t := c.findTransfer(m.TransferID, contact.id, true)
+		if t == nil || t.Status != TransferInProgress {
+			return
+		}
+		if len(m.Missing) > int(t.ChunkCount) {
+			c.log.Errorf("received invalid resume of %s from %s", t.Name, contact.nickname)
+			return
+		}
+		c.log.Debugf("%s is missing %d chunks of %s", contact.nickname, len(m.Missing), t.Name)
+		t.LastActivity = time.Now()
+		c.sendFileChunks(contact, t, m.Missing)
+	case fileComplete:
+		t := c.findTransfer(m.TransferID, contact.id, true)
+		if t == nil || t.Status != TransferInProgress {
+			return
+		}
+		t.dropData()
+		if m.Err != "" {
+			c.endTransfer(t, errors.New(m.Err))
+			return
+		}
+		c.endTransfer(t, nil)
+	default:
+		c.log.Errorf("received file message of unknown kind %d from %s", m.Kind, contact.nickname)
+	}
+}
+
+func (c *Client) processFileOffer(contact *Contact, m *fileMessage) {
+	if c.findTransfer(m.TransferID, contact.id, false) != nil {
+		return
+	}
+	if m.Size > MaxFileSize || m.ChunkCount == 0 || m.ChunkCount > maxFileChunks {
+		c.log.Errorf("received invalid file offer from %s", contact.nickname)
+		return
+	}
+	t := &fileTransfer{
+		ID:           m.TransferID,
+		ContactID:    contact.id,
+		Nickname:     contact.nickname,
+		Name:         m.Name,
+		Size:         m.Size,
+		Hash:         m.Hash,
+		Status:       TransferOffered,
+		ChunkCount:   m.ChunkCount,
+		StartTime:    time.Now(),
+		LastActivity: time.Now(),
+	}
+	c.transfers = append(c.transfers, t)
+	c.log.Infof("%s offered file %s (%d bytes).", contact.nickname, t.Name, t.Size)
+	c.emitEvent(&FileOfferedEvent{
+		Nickname:   contact.nickname,
+		TransferID: t.ID,
+		Name:       t.Name,
+		Size:       t.Size,
+	})
+}
+
+func (c *Client) processFileChunk(contact *Contact, m *fileMessage) {
+	t := c.findTransfer(m.TransferID, contact.id, false)
+	if t == nil || t.Status != TransferInProgress || m.Index >= t.ChunkCount {
+		return
+	}
+	t.LastActivity = time.Now()
+	if t.Received[m.Index] {
+		return
+	}
+	t.Chunks[m.Index] = m.Data
+	t.Received[m.Index] = true
+	t.ChunksDone++
+	if t.ChunksDone < t.ChunkCount {
+		return
+	}
+	err := c.saveFile(t)
+	t.Chunks = nil
+	t.Received = nil
+	complete := &fileMessage{
+		Kind:       fileComplete,
+		TransferID: t.ID,
+	}
+	if err != nil {
+		complete.Err = err.Error()
+	}
+	if sendErr := c.sendFileMessage(contact, complete); sendErr != nil {
+		c.log.Errorf("failure to send end of transfer of %s to %s: %s", t.Name, contact.nickname, sendErr)
+	}
+	c.endTransfer(t, err)
+}
+
+// saveFile verifies the received file and
+// writes it to the download directory.
+func (c *Client) saveFile(t *fileTransfer) error {
+	data := []byte{}
+	for _, chunk := range t.Chunks {
+		data = append(data, chunk...)
+	}
+	if uint64(len(data)) != t.Size {
+		return fmt.Errorf("received %d bytes, expected %d", len(data), t.Size)
+	}
+	hash := sha256.Sum256(data)
+	if !bytes.Equal(hash[:], t.Hash) {
+		return errors.New("file hash mismatch")
+	}
+	err := os.MkdirAll(c.downloadDir, 0700)
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(t.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		name = t.ID.String()
+	}
+	path := filepath.Join(c.downloadDir, name)
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			path = filepath.Join(c.downloadDir, fmt.Sprintf("%s.%d", name, i))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+			return err
+		}
+		t.Path = path
+		return nil
+	}
+}
+
+func (c *Client) endTransfer(t *fileTransfer, err error) {
+	t.Status = TransferComplete
+	if err != nil {
+		t.Status = TransferFailed
+		t.Err = err.Error()
+		c.log.Errorf("transfer of %s with %s failed: %s", t.Name, t.Nickname, err)
+	} else {
+		c.log.Infof("Transfer of %s with %s completed.", t.Name, t.Nickname)
+	}
+	c.emitEvent(&FileTransferCompletedEvent{
+		Nickname:   t.Nickname,
+		TransferID: t.ID,
+		Name:       t.Name,
+		Path:       t.Path,
+		Err:        err,
+	})
+}
+
+// isExpired returns true if the transfer is an offer from a contact
+// which was not accepted within fileOfferTimeout, or an outgoing
+// transfer the receiver hasn't answered within fileTransferTimeout.
+func (t *fileTransfer) isExpired(now time.Time) bool {
+	if t.Outgoing {
+		return (t.Status == TransferOffered || t.Status == TransferInProgress) && now.Sub(t.LastActivity) > fileTransferTimeout
+	}
+	return t.Status == TransferOffered && now.Sub(t.StartTime) > fileOfferTimeout
+}
+
+// dropData discards the file of an outgoing transfer
+// and the chunks waiting to be sent.
+func (t *fileTransfer) dropData() {
+	t.Data = nil
+	t.Pending = nil
+	t.ChunkIDs = nil
+}
+
+// expireFileOffers discards the offers of files which were not accepted
+// in time, and fails the outgoing transfers which have expired, dropping
+// the file they hold. It returns true if any transfer expired.
+func (c *Client) expireFileOffers() bool {
+	now := time.Now()
+	expired := false
+	transfers := []*fileTransfer{}
+	for _, t := range c.transfers {
+		if !t.isExpired(now) {
+			transfers = append(transfers, t)
+			continue
+		}
+		expired = true
+		if !t.Outgoing {
+			c.log.Warningf("discarding offer of file %s from %s which was not accepted", t.Name, t.Nickname)
+			continue
+		}
+		t.dropData()
+		c.endTransfer(t, errors.New("transfer expired"))
+		transfers = append(transfers, t)
+	}
+	c.transfers = transfers
+	return expired
+}
+
+// resumeTransfers asks the senders of stalled incoming transfers for
+// their missing chunks. It returns true if any were asked.
+func (c *Client) resumeTransfers() bool {
+	now := time.Now()
+	resumed := false
+	for _, t := range c.transfers {
+		if t.Outgoing || t.Status != TransferInProgress || now.Sub(t.LastActivity) < fileResumeInterval {
+			continue
+		}
+		contact, ok := c.contacts[t.ContactID]
+		if !ok {
+			continue
+		}
+		missing := []uint32{}
+		for i, received := range t.Received {
+			if !received {
+				missing = append(missing, uint32(i))
+			}
+		}
+		err := c.sendFileMessage(contact, &fileMessage{
+			Kind:       fileResume,
+			TransferID: t.ID,
+			Missing:    missing,
+		})
+		if err != nil {
+			c.log.Errorf("failure to resume transfer of %s: %s", t.Name, err)
+			continue
+		}
+		t.LastActivity = now
+		resumed = true
+	}
+	return resumed
+}
@@ -0,0 +1,184 @@
+// transfer_test.go - file transfer tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+func TestExpireFileOffers(t *testing.T) {
+	old := time.Now().Add(-fileOfferTimeout - time.Minute)
+	tests := []struct {
+		name     string
+		transfer *fileTransfer
+		expired  bool
+		kept     bool
+	}{
+		{"recent offer", &fileTransfer{Status: TransferOffered, StartTime: time.Now()}, false, true},
+		{"old offer", &fileTransfer{Status: TransferOffered, StartTime: old}, true, false},
+		{"old accepted offer", &fileTransfer{Status: TransferInProgress, StartTime: old}, false, true},
+		{"recent outgoing offer", &fileTransfer{Outgoing: true, Status: TransferOffered, StartTime: old, LastActivity: time.Now()}, false, true},
+		{"old outgoing offer", &fileTransfer{Outgoing: true, Status: TransferOffered, StartTime: old, LastActivity: old}, true, true},
+		{"stalled outgoing transfer", &fileTransfer{Outgoing: true, Status: TransferInProgress, StartTime: old, LastActivity: old}, true, true},
+		{"old completed outgoing transfer", &fileTransfer{Outgoing: true, Status: TransferComplete, StartTime: old, LastActivity: old}, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.transfer.Data = []byte("file")
+			test.transfer.Pending = []uint32{0}
+			c := &Client{
+				log:       testLog,
+				transfers: []*fileTransfer{test.transfer},
+			}
+			if expired := c.expireFileOffers(); expired != test.expired {
+				t.Fatalf("got expired %v, want %v", expired, test.expired)
+			}
+			if (len(c.transfers) == 1) != test.kept {
+				t.Fatalf("%d transfers left", len(c.transfers))
+			}
+			if !test.transfer.Outgoing || !test.expired {
+				return
+			}
+			if test.transfer.Status != TransferFailed {
+				t.Fatalf("expired transfer is %s", test.transfer.Status)
+			}
+			if test.transfer.Data != nil || test.transfer.Pending != nil {
+				t.Fatal("expired transfer kept the file")
+			}
+		})
+	}
+}
+
+// sentChunks returns the number of chunks of
+// the transfer which are in the client's outbox.
+func sentChunks(c *Client, transfer *fileTransfer) int {
+	n := 0
+	for _, id := range transfer.ChunkIDs {
+		if c.isQueued(transfer.ContactID, id) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSendFileWindow(t *testing.T) {
+	spools := newFakeSpoolService()
+	alice := newTestClient(t, "alice", spools)
+	bob := newTestClient(t, "bob", spools)
+	bob.SetDownloadDir(t.TempDir())
+	pairTestClients(t, alice, bob)
+
+	data := testMessage((2*fileChunkWindow + 3) * fileChunkLength)
+	id := newMessageID()
+	if err := alice.doSendFile(id, "bob", "file", data); err != nil {
+		t.Fatal(err)
+	}
+	settle(alice)
+	poll(bob)
+	if err := bob.doAcceptFile(id); err != nil {
+		t.Fatal(err)
+	}
+	settle(bob)
+
+	// Alice reads the acceptance while the spool writes are held up,
+	// only a window of the chunks is queued.
+	spools.writeBlock = make(chan struct{})
+	alice.readInbox()
+	for len(alice.readsInFlight) > 0 {
+		alice.processReadInboxResult(<-alice.readInboxResultChan)
+	}
+	sending := alice.findTransfer(id, alice.contactNicknames["bob"].id, true)
+	if sending == nil || sending.Status != TransferInProgress {
+		t.Fatal("transfer was not accepted")
+	}
+	if n := sentChunks(alice, sending); n != fileChunkWindow {
+		t.Fatalf("%d chunks queued, want %d", n, fileChunkWindow)
+	}
+	if len(sending.Pending) != int(sending.ChunkCount)-fileChunkWindow {
+		t.Fatalf("%d chunks pending, want %d", len(sending.Pending), int(sending.ChunkCount)-fileChunkWindow)
+	}
+	close(spools.writeBlock)
+	settle(alice)
+	if sending.ChunksDone != sending.ChunkCount || len(sending.Pending) != 0 {
+		t.Fatalf("%d of %d chunks written", sending.ChunksDone, sending.ChunkCount)
+	}
+
+	receiving := bob.findTransfer(id, bob.contactNicknames["alice"].id, false)
+	for i := 0; i < 10 && receiving.Status == TransferInProgress; i++ {
+		poll(bob)
+	}
+	if receiving.Status != TransferComplete {
+		t.Fatalf("transfer is %s: %s", receiving.Status, receiving.Err)
+	}
+	received, err := ioutil.ReadFile(receiving.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("received file differs")
+	}
+	settle(bob)
+	poll(alice)
+	if sending.Status != TransferComplete || sending.Data != nil {
+		t.Fatal("sender didn't end the transfer")
+	}
+}
+
+func TestFileResumeTooLong(t *testing.T) {
+	spools := newFakeSpoolService()
+	alice := newTestClient(t, "alice", spools)
+	bob := newTestClient(t, "bob", spools)
+	pairTestClients(t, alice, bob)
+	contact := alice.contactNicknames["bob"]
+	transfer := &fileTransfer{
+		ID:           1,
+		ContactID:    contact.id,
+		Outgoing:     true,
+		Status:       TransferInProgress,
+		ChunkCount:   2,
+		Data:         testMessage(2 * fileChunkLength),
+		LastActivity: time.Now(),
+	}
+	alice.transfers = []*fileTransfer{transfer}
+	resume := func(missing []uint32) {
+		var body []byte
+		err := codec.NewEncoderBytes(&body, cborHandle).Encode(&fileMessage{
+			Kind:       fileResume,
+			TransferID: transfer.ID,
+			Missing:    missing,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice.processFileMessage(contact, body)
+		settle(alice)
+	}
+
+	resume([]uint32{0, 1, 0})
+	if transfer.ChunksDone != 0 || len(transfer.Pending) != 0 {
+		t.Fatal("chunks were sent for a resume listing more chunks than the file has")
+	}
+	resume([]uint32{1})
+	if transfer.ChunksDone != 1 {
+		t.Fatalf("%d chunks written, want 1", transfer.ChunksDone)
+	}
+}
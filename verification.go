@@ -0,0 +1,175 @@
+// verification.go - contact verification with safety numbers
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	// safetyNumberGroups is the number of five digit
+	// groups a safety number is made of.
+	safetyNumberGroups = 12
+
+	// safetyNumberIterations is the number of times the identity keys
+	// are hashed, which makes it costlier to find a key exchange whose
+	// safety number matches that of another.
+	safetyNumberIterations = 5200
+)
+
+// safetyNumberPrefix separates the safety
+// number hash from other uses of the keys.
+var safetyNumberPrefix = []byte("catshadow safety number")
+
+type getSafetyNumber struct {
+	Name         string
+	ResponseChan chan safetyNumberResult
+}
+
+type safetyNumberResult struct {
+	SafetyNumber string
+	Err          error
+}
+
+type setVerified struct {
+	Name         string
+	SafetyNumber string
+	Verified     bool
+	ResponseChan chan error
+}
+
+// SafetyNumber returns the safety number of the contact with the
+// given nickname. It is derived from the double ratchet identity keys
+// of both parties and so the contact sees the same safety number,
+// unless the key exchange was tampered with. Comparing it out of band
+// confirms the ratchet was established with the intended person.
+func (c *Client) SafetyNumber(ctx context.Context, nickname string) (string, error) {
+	responseChan := make(chan safetyNumberResult, 1)
+	select {
+	case c.getSafetyNumberChan <- getSafetyNumber{
+		Name:         nickname,
+		ResponseChan: responseChan,
+	}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-c.HaltCh():
+		return "", errHalted
+	}
+	select {
+	case result := <-responseChan:
+		return result.SafetyNumber, result.Err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-c.HaltCh():
+		return "", errHalted
+	}
+}
+
+// VerifyContact compares the given safety number, as read by the
+// contact, with the contact's safety number and marks the contact as
+// verified if they match. Spaces in the safety number are ignored.
+func (c *Client) VerifyContact(ctx context.Context, nickname, safetyNumber string) error {
+	return c.setVerified(ctx, nickname, safetyNumber, true)
+}
+
+// SetContactVerified marks the contact with the given nickname as
+// verified or not, without comparing safety numbers.
+func (c *Client) SetContactVerified(ctx context.Context, nickname string, verified bool) error {
+	return c.setVerified(ctx, nickname, "", verified)
+}
+
+func (c *Client) setVerified(ctx context.Context, nickname, safetyNumber string, verified bool) error {
+	responseChan := make(chan error, 1)
+	select {
+	case c.setVerifiedChan <- setVerified{
+		Name:         nickname,
+		SafetyNumber: safetyNumber,
+		Verified:     verified,
+		ResponseChan: responseChan,
+	}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.HaltCh():
+		return errHalted
+	}
+	return c.waitResponse(ctx, responseChan)
+}
+
+// safetyNumber derives a safety number from the two identity keys, it
+// doesn't depend on their order so that both parties compute the same.
+func safetyNumber(identity1, identity2 []byte) string {
+	if bytes.Compare(identity1, identity2) > 0 {
+		identity1, identity2 = identity2, identity1
+	}
+	h := sha512.New()
+	h.Write(safetyNumberPrefix)
+	h.Write(identity1)
+	h.Write(identity2)
+	digest := h.Sum(nil)
+	for i := 1; i < safetyNumberIterations; i++ {
+		h.Reset()
+		h.Write(digest)
+		h.Write(identity1)
+		h.Write(identity2)
+		digest = h.Sum(digest[:0])
+	}
+	groups := make([]string, safetyNumberGroups)
+	for i := range groups {
+		// Each group is taken from five bytes of the digest.
+		chunk := make([]byte, 8)
+		copy(chunk[3:], digest[i*5:i*5+5])
+		groups[i] = fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk)%100000)
+	}
+	return strings.Join(groups, " ")
+}
+
+// contactSafetyNumber returns the safety number of the
+// contact whose key exchange completed successfully.
+func (c *Client) contactSafetyNumber(nickname string) (*Contact, string, error) {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return nil, "", fmt.Errorf("contact %s not found", nickname)
+	}
+	if contact.isPending {
+		return nil, "", fmt.Errorf("key exchange with %s has not completed", nickname)
+	}
+	if contact.pandaResult != "" {
+		return nil, "", fmt.Errorf("key exchange with %s failed", nickname)
+	}
+	return contact, safetyNumber(contact.ratchet.MyIdentityPublic[:], contact.ratchet.TheirIdentityPublic[:]), nil
+}
+
+func (c *Client) doSetVerified(nickname, number string, verified bool) error {
+	contact, expected, err := c.contactSafetyNumber(nickname)
+	if err != nil {
+		return err
+	}
+	if number != "" && strings.Join(strings.Fields(number), "") != strings.Replace(expected, " ", "", -1) {
+		return fmt.Errorf("safety number of %s does not match", nickname)
+	}
+	contact.verified = verified
+	if verified {
+		c.log.Infof("Verified %s.", nickname)
+	}
+	c.save()
+	return nil
+}
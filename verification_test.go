@@ -0,0 +1,80 @@
+// verification_test.go - contact verification tests
+// Copyright (C) 2019  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSafetyNumber(t *testing.T) {
+	spools := newFakeSpoolService()
+	alice := newTestClient(t, "alice", spools)
+	bob := newTestClient(t, "bob", spools)
+	pairTestClients(t, alice, bob)
+
+	_, aliceNumber, err := alice.contactSafetyNumber("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, bobNumber, err := bob.contactSafetyNumber("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aliceNumber != bobNumber {
+		t.Fatalf("alice sees %s, bob sees %s", aliceNumber, bobNumber)
+	}
+	if groups := strings.Fields(aliceNumber); len(groups) != safetyNumberGroups {
+		t.Fatalf("safety number has %d groups", len(groups))
+	}
+
+	tests := []struct {
+		name   string
+		number string
+		valid  bool
+	}{
+		{"other safety number", strings.Repeat("00000 ", safetyNumberGroups), false},
+		{"truncated", bobNumber[:len(bobNumber)-1], false},
+		{"matching", bobNumber, true},
+		{"without spaces", strings.Replace(bobNumber, " ", "", -1), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			contact := alice.contactNicknames["bob"]
+			contact.verified = false
+			err := alice.doSetVerified("bob", test.number, true)
+			if (err == nil) != test.valid {
+				t.Fatalf("got error %v, want valid %v", err, test.valid)
+			}
+			if contact.verified != test.valid {
+				t.Fatalf("got verified %v, want %v", contact.verified, test.valid)
+			}
+		})
+	}
+
+	// A new key exchange invalidates the verification.
+	contact := alice.contactNicknames["bob"]
+	if err := contact.resetKeyExchange(alice.contactSpoolReader(contact)); err != nil {
+		t.Fatal(err)
+	}
+	if contact.verified {
+		t.Fatal("verification survived a new key exchange")
+	}
+	if _, _, err := alice.contactSafetyNumber("bob"); err == nil {
+		t.Fatal("got a safety number for a pending key exchange")
+	}
+}